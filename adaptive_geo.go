@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/mmcloughlin/geohash"
+)
+
+const (
+	geoOverflow                = "overflow"
+	geoMaxHashPrecision        = uint(12)
+	geoDefaultMaxHashPrecision = uint(4)
+	geoDefaultSplitThreshold   = uint64(1000)
+	geoDefaultMaxCells         = 1000
+)
+
+// AdaptiveGeoHashConfig configures geo hashing where busy cells are subdivided
+// to a finer precision instead of using a single precision everywhere.
+type AdaptiveGeoHashConfig struct {
+	// MinPrecision is the precision every coordinate starts at (1-12).
+	MinPrecision uint
+	// MaxPrecision is the finest precision a busy cell can be subdivided to (1-12).
+	MaxPrecision uint
+	// SplitThreshold is the number of requests a cell must see before it is subdivided.
+	SplitThreshold uint64
+	// MaxCells caps the total number of distinct geo_hash label values.
+	MaxCells int
+}
+
+// adaptiveGeoHasher builds a quadtree-like set of geo hash cells: a cell that
+// has seen SplitThreshold requests is split into its 32 children, up to
+// MaxPrecision. Once MaxCells distinct cells are in use no more cells are
+// created, coordinates stay on their coarser parent cell or fall into the
+// overflow cell.
+type adaptiveGeoHasher struct {
+	config AdaptiveGeoHashConfig
+
+	mu         sync.Mutex
+	counts     map[string]uint64
+	split      map[string]struct{}
+	overflowed bool
+}
+
+var adaptiveGeo *adaptiveGeoHasher
+
+func newAdaptiveGeoHasher(config AdaptiveGeoHashConfig) *adaptiveGeoHasher {
+	if config.MinPrecision < 1 || config.MinPrecision > geoMaxHashPrecision {
+		config.MinPrecision = geoDefaultHashPrecision
+	}
+	if config.MaxPrecision < 1 || config.MaxPrecision > geoMaxHashPrecision {
+		config.MaxPrecision = geoDefaultMaxHashPrecision
+	}
+	if config.MaxPrecision < config.MinPrecision {
+		config.MaxPrecision = config.MinPrecision
+	}
+	if config.SplitThreshold == 0 {
+		config.SplitThreshold = geoDefaultSplitThreshold
+	}
+	if config.MaxCells <= 0 {
+		config.MaxCells = geoDefaultMaxCells
+	}
+
+	a := &adaptiveGeoHasher{config: config}
+	a.reset()
+	return a
+}
+
+// reset forgets all cells, it must be called whenever the metrics are reset
+// so the cell budget matches the label values that are actually exported.
+func (a *adaptiveGeoHasher) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.counts = make(map[string]uint64)
+	a.split = make(map[string]struct{})
+	a.overflowed = false
+}
+
+// stats returns the number of cells in use and split, and whether a coordinate has fallen
+// into the overflow cell since the last reset.
+func (a *adaptiveGeoHasher) stats() (int, int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.counts), len(a.split), a.overflowed
+}
+
+func (a *adaptiveGeoHasher) hash(lat, lon float64) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	precision := a.config.MinPrecision
+	cell := geohash.EncodeWithPrecision(lat, lon, precision)
+
+	for precision < a.config.MaxPrecision {
+		if _, isSplit := a.split[cell]; !isSplit {
+			break
+		}
+		child := geohash.EncodeWithPrecision(lat, lon, precision+1)
+		if !a.hasRoomFor(child) {
+			break
+		}
+		precision++
+		cell = child
+	}
+
+	if !a.hasRoomFor(cell) {
+		a.overflowed = true
+		return geoOverflow
+	}
+
+	a.counts[cell]++
+	if a.counts[cell] >= a.config.SplitThreshold && precision < a.config.MaxPrecision {
+		a.split[cell] = struct{}{}
+	}
+
+	return cell
+}
+
+func (a *adaptiveGeoHasher) hasRoomFor(cell string) bool {
+	if _, known := a.counts[cell]; known {
+		return true
+	}
+	return len(a.counts) < a.config.MaxCells
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	sydneyLat, sydneyLon     = -33.8601, 151.2101
+	canberraLat, canberraLon = -35.2809, 149.1300
+)
+
+func TestAdaptiveGeoHasher_SplitsBusyCells(t *testing.T) {
+	a := newAdaptiveGeoHasher(AdaptiveGeoHashConfig{
+		MinPrecision:   2,
+		MaxPrecision:   4,
+		SplitThreshold: 2,
+		MaxCells:       100,
+	})
+
+	assert.Equal(t, "r3", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3g", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3g", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3gx", a.hash(sydneyLat, sydneyLon))
+	// MaxPrecision reached, no further subdivision
+	assert.Equal(t, "r3gx", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3gx", a.hash(sydneyLat, sydneyLon))
+
+	// a quieter location in the same split cell goes to its own child
+	assert.Equal(t, "r3d", a.hash(canberraLat, canberraLon))
+}
+
+func TestAdaptiveGeoHasher_EnforcesCellBudget(t *testing.T) {
+	a := newAdaptiveGeoHasher(AdaptiveGeoHashConfig{
+		MinPrecision:   2,
+		MaxPrecision:   4,
+		SplitThreshold: 1,
+		MaxCells:       2,
+	})
+
+	assert.Equal(t, "r3", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3g", a.hash(sydneyLat, sydneyLon))
+	// budget used up, stays on the coarsest known cell
+	assert.Equal(t, "r3g", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3", a.hash(canberraLat, canberraLon))
+	cells, split, overflowed := a.stats()
+	assert.Equal(t, []interface{}{2, 2, false}, []interface{}{cells, split, overflowed})
+	// a new top level cell does not fit either
+	assert.Equal(t, geoOverflow, a.hash(51.5072, -0.1276))
+	_, _, overflowed = a.stats()
+	assert.True(t, overflowed)
+
+	a.reset()
+	_, _, overflowed = a.stats()
+	assert.False(t, overflowed)
+}
+
+func TestAdaptiveGeoHasher_Defaults(t *testing.T) {
+	a := newAdaptiveGeoHasher(AdaptiveGeoHashConfig{MinPrecision: 5, MaxPrecision: 3})
+
+	assert.Equal(t, uint(5), a.config.MinPrecision)
+	assert.Equal(t, uint(5), a.config.MaxPrecision)
+	assert.Equal(t, geoDefaultSplitThreshold, a.config.SplitThreshold)
+	assert.Equal(t, geoDefaultMaxCells, a.config.MaxCells)
+
+	a = newAdaptiveGeoHasher(AdaptiveGeoHashConfig{})
+	assert.Equal(t, geoDefaultHashPrecision, a.config.MinPrecision)
+	assert.Equal(t, geoDefaultMaxHashPrecision, a.config.MaxPrecision)
+}
+
+func TestAdaptiveGeoHasher_Reset(t *testing.T) {
+	a := newAdaptiveGeoHasher(AdaptiveGeoHashConfig{SplitThreshold: 1})
+
+	assert.Equal(t, "r3", a.hash(sydneyLat, sydneyLon))
+	assert.Equal(t, "r3g", a.hash(sydneyLat, sydneyLon))
+
+	a.reset()
+	assert.Equal(t, "r3", a.hash(sydneyLat, sydneyLon))
+}
@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// OverflowPolicy is what an AsyncWriter does with a write when its buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room in the buffer.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered lines to make room.
+	OverflowDropOldest
+	// OverflowDropNewest discards the line being written.
+	OverflowDropNewest
+)
+
+var overflowPolicies = map[string]OverflowPolicy{
+	"block":       OverflowBlock,
+	"drop_oldest": OverflowDropOldest,
+	"drop_newest": OverflowDropNewest,
+}
+
+// ParseOverflowPolicy returns the OverflowPolicy named "block", "drop_oldest" or "drop_newest".
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	policy, ok := overflowPolicies[name]
+	if !ok {
+		return OverflowBlock, errors.Errorf("unknown overflow policy %q", name)
+	}
+	return policy, nil
+}
+
+// AsyncWriter buffers writes in a bounded ring buffer and writes them to the output from a
+// separate goroutine, so a slow output does not stall the reader. Each Write is kept as a
+// single unit, it is never split or merged with other writes.
+type AsyncWriter struct {
+	output   io.Writer
+	maxBytes int
+	policy   OverflowPolicy
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	ring     [][]byte
+	head     int
+	count    int
+	bytes    int
+	dropped  int
+	closed   bool
+	done     chan struct{}
+
+	// onError is called with the errors writing to the output, which panic if it is nil
+	onError func(error)
+}
+
+var (
+	asyncWritersMu sync.Mutex
+	asyncWriters   []*AsyncWriter
+	// the bytes dropped by the AsyncWriters closed since InitMetrics, so the total doesn't go down
+	closedDroppedBytes int
+)
+
+// NewAsyncWriter starts an AsyncWriter that buffers up to maxBytes for the output.
+func NewAsyncWriter(output io.Writer, maxBytes int, policy OverflowPolicy) *AsyncWriter {
+	return newAsyncWriter(output, maxBytes, policy, nil)
+}
+
+func newAsyncWriter(output io.Writer, maxBytes int, policy OverflowPolicy, onError func(error)) *AsyncWriter {
+	w := &AsyncWriter{
+		output:   output,
+		maxBytes: maxBytes,
+		policy:   policy,
+		ring:     make([][]byte, 64),
+		done:     make(chan struct{}),
+		onError:  onError,
+	}
+	w.notEmpty = sync.NewCond(&w.mu)
+	w.notFull = sync.NewCond(&w.mu)
+
+	asyncWritersMu.Lock()
+	asyncWriters = append(asyncWriters, w)
+	asyncWritersMu.Unlock()
+
+	go w.run()
+
+	return w
+}
+
+// Write queues a copy of p, it only returns an error if the writer is closed.
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && !w.fits(len(line)) {
+		switch w.policy {
+		case OverflowDropNewest:
+			w.dropped += len(line)
+			return len(p), nil
+		case OverflowDropOldest:
+			w.dropped += len(w.pop())
+		default:
+			w.notFull.Wait()
+		}
+	}
+	if w.closed {
+		return 0, errors.New("AsyncWriter is closed")
+	}
+
+	w.push(line)
+	w.notEmpty.Signal()
+
+	return len(p), nil
+}
+
+// Close writes out the buffered lines and stops the writer goroutine.
+func (w *AsyncWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.notEmpty.Broadcast()
+	w.notFull.Broadcast()
+	w.mu.Unlock()
+
+	<-w.done
+
+	_, _, dropped := w.stats()
+	asyncWritersMu.Lock()
+	defer asyncWritersMu.Unlock()
+	for i, other := range asyncWriters {
+		if other == w {
+			asyncWriters = append(asyncWriters[:i], asyncWriters[i+1:]...)
+			closedDroppedBytes += dropped
+			break
+		}
+	}
+
+	return nil
+}
+
+// reconfigure changes the output and the buffer of the writer, so the one wrapping stdout is
+// reused when the inputs are set up again. The buffered lines are written to the new output.
+func (w *AsyncWriter) reconfigure(output io.Writer, maxBytes int, policy OverflowPolicy) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.output = output
+	w.maxBytes = maxBytes
+	w.policy = policy
+	w.notFull.Broadcast()
+}
+
+// stats returns the buffered lines and bytes and the total bytes dropped.
+func (w *AsyncWriter) stats() (lines int, bytes int, dropped int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.count, w.bytes, w.dropped
+}
+
+func (w *AsyncWriter) run() {
+	defer close(w.done)
+
+	for {
+		w.mu.Lock()
+		for w.count == 0 && !w.closed {
+			w.notEmpty.Wait()
+		}
+		if w.count == 0 {
+			w.mu.Unlock()
+			return
+		}
+		line := w.pop()
+		output := w.output
+		w.notFull.Broadcast()
+		w.mu.Unlock()
+
+		_, err := output.Write(line)
+		if err != nil && w.onError != nil {
+			w.onError(err)
+		} else if err != nil {
+			panic(errors.Wrapf(err, "Writing to output failed"))
+		}
+	}
+}
+
+// fits reports whether a line of size bytes can be buffered, a line larger than the
+// whole buffer is accepted once the buffer is empty.
+func (w *AsyncWriter) fits(size int) bool {
+	return w.count == 0 || w.bytes+size <= w.maxBytes
+}
+
+func (w *AsyncWriter) push(line []byte) {
+	if w.count == len(w.ring) {
+		grown := make([][]byte, 2*len(w.ring))
+		for i := 0; i < w.count; i++ {
+			grown[i] = w.ring[(w.head+i)%len(w.ring)]
+		}
+		w.ring = grown
+		w.head = 0
+	}
+	w.ring[(w.head+w.count)%len(w.ring)] = line
+	w.count++
+	w.bytes += len(line)
+}
+
+func (w *AsyncWriter) pop() []byte {
+	line := w.ring[w.head]
+	w.ring[w.head] = nil
+	w.head = (w.head + 1) % len(w.ring)
+	w.count--
+	w.bytes -= len(line)
+	return line
+}
+
+// asyncWriterStats sums the stats of all the open AsyncWriters, the bytes dropped also include
+// the ones dropped by the AsyncWriters closed since InitMetrics.
+func asyncWriterStats() (lines int, bytes int, dropped int) {
+	asyncWritersMu.Lock()
+	defer asyncWritersMu.Unlock()
+
+	dropped = closedDroppedBytes
+	for _, w := range asyncWriters {
+		l, b, d := w.stats()
+		lines += l
+		bytes += b
+		dropped += d
+	}
+	return lines, bytes, dropped
+}
+
+// resetClosedDroppedBytes starts the total of dropped bytes over, with the other metrics.
+func resetClosedDroppedBytes() {
+	asyncWritersMu.Lock()
+	defer asyncWritersMu.Unlock()
+	closedDroppedBytes = 0
+}
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedWriter blocks every Write until the gate is opened.
+type gatedWriter struct {
+	gate chan struct{}
+	mu   sync.Mutex
+	buf  bytes.Buffer
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{gate: make(chan struct{})}
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	<-g.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.buf.Write(p)
+}
+
+func (g *gatedWriter) String() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.buf.String()
+}
+
+// waitForQueue waits until the writer goroutine has taken all but the given number of lines off the queue.
+func waitForQueue(t *testing.T, w *AsyncWriter, lines int) {
+	assert.Eventually(t, func() bool {
+		l, _, _ := w.stats()
+		return l == lines
+	}, time.Second, time.Millisecond)
+}
+
+func TestAsyncWriterWritesInOrder(t *testing.T) {
+	var output bytes.Buffer
+	w := NewAsyncWriter(&output, 1024, OverflowBlock)
+
+	for _, line := range []string{"a\n", "b\n", "c\n"} {
+		n, err := w.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+	}
+	assert.NoError(t, w.Close())
+
+	assert.Equal(t, "a\nb\nc\n", output.String())
+
+	_, err := w.Write([]byte("d\n"))
+	assert.Error(t, err)
+}
+
+func TestAsyncWriterDropNewest(t *testing.T) {
+	output := newGatedWriter()
+	w := NewAsyncWriter(output, 4, OverflowDropNewest)
+
+	_, _ = w.Write([]byte("1\n"))
+	waitForQueue(t, w, 0) // "1" is being written
+	_, _ = w.Write([]byte("2\n"))
+	_, _ = w.Write([]byte("3\n"))
+	_, _ = w.Write([]byte("4\n"))
+
+	lines, queued, dropped := w.stats()
+	assert.Equal(t, 2, lines)
+	assert.Equal(t, 4, queued)
+	assert.Equal(t, 2, dropped)
+
+	close(output.gate)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "1\n2\n3\n", output.String())
+}
+
+func TestAsyncWriterDropOldest(t *testing.T) {
+	output := newGatedWriter()
+	w := NewAsyncWriter(output, 4, OverflowDropOldest)
+
+	_, _ = w.Write([]byte("1\n"))
+	waitForQueue(t, w, 0)
+	_, _ = w.Write([]byte("2\n"))
+	_, _ = w.Write([]byte("3\n"))
+	_, _ = w.Write([]byte("4\n"))
+
+	_, _, dropped := w.stats()
+	assert.Equal(t, 2, dropped)
+
+	close(output.gate)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "1\n3\n4\n", output.String())
+}
+
+func TestAsyncWriterBlock(t *testing.T) {
+	output := newGatedWriter()
+	w := NewAsyncWriter(output, 4, OverflowBlock)
+
+	_, _ = w.Write([]byte("1\n"))
+	waitForQueue(t, w, 0)
+	_, _ = w.Write([]byte("2\n"))
+	_, _ = w.Write([]byte("3\n"))
+
+	written := make(chan struct{})
+	go func() {
+		_, _ = w.Write([]byte("4\n"))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("expected Write to block while the buffer is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(output.gate)
+	<-written
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "1\n2\n3\n4\n", output.String())
+
+	_, _, dropped := w.stats()
+	assert.Equal(t, 0, dropped)
+}
+
+func TestAsyncWriterOversizedLine(t *testing.T) {
+	var output bytes.Buffer
+	w := NewAsyncWriter(&output, 2, OverflowDropNewest)
+
+	_, _ = w.Write([]byte("longer than the buffer\n"))
+	assert.NoError(t, w.Close())
+
+	assert.Equal(t, "longer than the buffer\n", output.String())
+}
+
+func TestAsyncWriterMetrics(t *testing.T) {
+	InitMetrics()
+
+	output := newGatedWriter()
+	w := NewAsyncWriter(output, 4, OverflowDropNewest)
+
+	_, _ = w.Write([]byte("1\n"))
+	waitForQueue(t, w, 0)
+	_, _ = w.Write([]byte("2\n"))
+	_, _ = w.Write([]byte("3\n"))
+	_, _ = w.Write([]byte("dropped\n"))
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_passthrough_queue_lines 2`)
+	assert.Contains(t, actual, `section_http_passthrough_queue_bytes 4`)
+	assert.Contains(t, actual, `section_http_passthrough_dropped_bytes_total 8`)
+
+	close(output.gate)
+	assert.NoError(t, w.Close())
+
+	actual = gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_passthrough_queue_lines 0`)
+	// the bytes dropped by a closed writer are still counted
+	assert.Contains(t, actual, `section_http_passthrough_dropped_bytes_total 8`)
+}
+
+func TestSetupOutputReusesWriter(t *testing.T) {
+	defer func() { outputWriter = nil }()
+	t.Setenv("MODULE_METRICS_PASSTHROUGH_BUFFER_BYTES", "4")
+
+	var first, second bytes.Buffer
+	output, err := setupOutput(&first)
+	assert.NoError(t, err)
+	writers := len(asyncWriters)
+
+	t.Setenv("MODULE_METRICS_PASSTHROUGH_BUFFER_BYTES", "1024")
+	t.Setenv("MODULE_METRICS_PASSTHROUGH_OVERFLOW", "drop_newest")
+	for i := 0; i < 5; i++ {
+		reused, err := setupOutput(&second)
+		assert.NoError(t, err)
+		assert.Same(t, output, reused)
+	}
+	assert.Len(t, asyncWriters, writers)
+	assert.Equal(t, 1024, outputWriter.maxBytes)
+	assert.Equal(t, OverflowDropNewest, outputWriter.policy)
+
+	_, _ = output.Write([]byte("line\n"))
+	assert.NoError(t, outputWriter.Close())
+	assert.Empty(t, first.String())
+	assert.Equal(t, "line\n", second.String())
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	policy, err := ParseOverflowPolicy("drop_oldest")
+	assert.NoError(t, err)
+	assert.Equal(t, OverflowDropOldest, policy)
+
+	policy, err = ParseOverflowPolicy("drop_newest")
+	assert.NoError(t, err)
+	assert.Equal(t, OverflowDropNewest, policy)
+
+	policy, err = ParseOverflowPolicy("block")
+	assert.NoError(t, err)
+	assert.Equal(t, OverflowBlock, policy)
+
+	_, err = ParseOverflowPolicy("sometimes")
+	assert.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+const benchmarkLogLine = `{"time":"2019-06-20T01:34:36+00:00","request_time":"0.077","hostname":"www.example.com","request_uri":"/a/path?q=1","http_accept_encoding":"gzip","http_x_forwarded_proto":"https","http_upgrade":"-","http_connection":"-","status":"200","bytes_sent":"1959","body_bytes_sent":"1498","upstream_label":"default","upstream_addr":"198.51.100.1:443","upstream_status":"200","upstream_request_connection":"","upstream_request_host":"in.example.com","upstream_header_time":"0.077","upstream_connect_time":"0.057","upstream_response_time":"0.077","upstream_response_length":"1498","upstream_bytes_received":"1889","content_type":"application/javascript","upstream_http_cache_control":"max-age=60","upstream_http_content_length":"-","upstream_http_content_encoding":"gzip","upstream_http_transfer_encoding":"chunked","sent_http_content_length":"-","sent_http_content_encoding":"gzip","sent_http_transfer_encoding":"chunked","section-io-id":"b1ea9bc0be7edfc997bc18a9f6b20d68","request":{"http_user_agent":"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/76.0.3809.100 Safari/537.36"}}` + "\n"
+
+func BenchmarkProcessLine(b *testing.B) {
+	InitMetrics("status", "content_type", "hostname")
+	r := &reader{source: defaultSource, parser: JSONParser, output: io.Discard, errorWriter: io.Discard}
+	line := []byte(benchmarkLogLine)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.processLine(line)
+	}
+}
+
+func BenchmarkJSONParser(b *testing.B) {
+	InitMetrics("status", "content_type", "hostname")
+	line := []byte(benchmarkLogLine)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = JSONParser(line)
+	}
+}
+
+// BenchmarkJSONUnmarshal is the decoding JSONParser replaced, for comparison.
+func BenchmarkJSONUnmarshal(b *testing.B) {
+	line := []byte(benchmarkLogLine)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var logline map[string]interface{}
+		_ = json.Unmarshal(line, &logline)
+	}
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultDebugConfigPath = "/debug/config"
+
+// debugConfig is the effective configuration and label state returned by /debug/config.
+type debugConfig struct {
+	Labels              debugLabels    `json:"labels"`
+	DistinctLabelValues map[string]int `json:"distinct_label_values"`
+	MaxLabelValueLength int            `json:"max_label_value_length"`
+	Hostnames           debugHostnames `json:"hostnames"`
+	Geo                 debugGeo       `json:"geo"`
+	Workers             int            `json:"workers"`
+	MaxLineBytes        int            `json:"max_line_bytes"`
+	OversizedLines      string         `json:"oversized_lines"`
+
+	RequestHistograms           bool    `json:"request_histograms"`
+	NativeHistogramBucketFactor float64 `json:"native_histogram_bucket_factor"`
+}
+
+type debugLabels struct {
+	LogFieldNames      []string `json:"log_field_names"`
+	SanitizedP8sLabels []string `json:"sanitized_p8s_labels"`
+	WithGeoLabel       []string `json:"with_geo_label"`
+	RequestLabels      []string `json:"request_labels"`
+}
+
+type debugHostnames struct {
+	Metrics    bool     `json:"metrics"`
+	Max        int      `json:"max"`
+	Count      int      `json:"count"`
+	Overflowed bool     `json:"overflowed"`
+	Tracked    []string `json:"tracked"`
+}
+
+type debugGeo struct {
+	Enabled         bool              `json:"enabled"`
+	Precision       uint              `json:"precision"`
+	BytesMetrics    bool              `json:"bytes_metrics"`
+	PageViewMetrics bool              `json:"page_view_metrics"`
+	Adaptive        *debugAdaptiveGeo `json:"adaptive,omitempty"`
+}
+
+type debugAdaptiveGeo struct {
+	MinPrecision   uint   `json:"min_precision"`
+	MaxPrecision   uint   `json:"max_precision"`
+	SplitThreshold uint64 `json:"split_threshold"`
+	MaxCells       int    `json:"max_cells"`
+	Cells          int    `json:"cells"`
+	SplitCells     int    `json:"split_cells"`
+	Overflowed     bool   `json:"overflowed"`
+}
+
+// currentDebugConfig collects the debugConfig, counting the distinct values of each label
+// currently exported on the request counter.
+func currentDebugConfig() (*debugConfig, error) {
+	config := &debugConfig{
+		Labels: debugLabels{
+			LogFieldNames:      logFieldNames,
+			SanitizedP8sLabels: sanitizedP8sLabels,
+			WithGeoLabel:       withGeoLabel,
+			RequestLabels:      requestLabels,
+		},
+		DistinctLabelValues: map[string]int{},
+		MaxLabelValueLength: maxLabelValueLength,
+		Geo: debugGeo{
+			Enabled:         isGeoHashing,
+			Precision:       effectiveHashPrecision,
+			BytesMetrics:    includeGeoBytesMetrics,
+			PageViewMetrics: includeGeoPageViewMetrics,
+		},
+		Workers:      workers,
+		MaxLineBytes: maxLineBytes,
+
+		RequestHistograms:           includeRequestHistograms,
+		NativeHistogramBucketFactor: nativeHistogramBucketFactor,
+	}
+	for name, policy := range oversizedLinePolicies {
+		if policy == oversizedLinePolicy {
+			config.OversizedLines = name
+		}
+	}
+
+	uniqueHostnameMu.RLock()
+	config.Hostnames = debugHostnames{
+		Metrics:    includeHostnameMetrics,
+		Max:        maxUniqueHostnames,
+		Count:      len(uniqueHostnameMap),
+		Overflowed: uniqueHostnamesOverflowed,
+		Tracked:    make([]string, 0, len(uniqueHostnameMap)),
+	}
+	for hostname := range uniqueHostnameMap {
+		config.Hostnames.Tracked = append(config.Hostnames.Tracked, hostname)
+	}
+	uniqueHostnameMu.RUnlock()
+	sort.Strings(config.Hostnames.Tracked)
+
+	if adaptiveGeo != nil {
+		cells, split, overflowed := adaptiveGeo.stats()
+		config.Geo.Adaptive = &debugAdaptiveGeo{
+			MinPrecision:   adaptiveGeo.config.MinPrecision,
+			MaxPrecision:   adaptiveGeo.config.MaxPrecision,
+			SplitThreshold: adaptiveGeo.config.SplitThreshold,
+			MaxCells:       adaptiveGeo.config.MaxCells,
+			Cells:          cells,
+			SplitCells:     split,
+			Overflowed:     overflowed,
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	requestsName := prometheus.BuildFQName(promeNamespace, promeSubsystem, "request_count_total")
+	values := map[string]map[string]struct{}{}
+	for _, family := range families {
+		if family.GetName() != requestsName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if values[label.GetName()] == nil {
+					values[label.GetName()] = map[string]struct{}{}
+				}
+				values[label.GetName()][label.GetValue()] = struct{}{}
+			}
+		}
+	}
+	for _, label := range requestLabels {
+		config.DistinctLabelValues[label] = len(values[label])
+	}
+
+	return config, nil
+}
+
+func debugConfigHandler(w http.ResponseWriter, _ *http.Request) {
+	config, err := currentDebugConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(config)
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugConfigHandler(t *testing.T) {
+	// not served unless enabled
+	InitMetrics("hostname", "status")
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, defaultDebugConfigPath, nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	t.Setenv("MODULE_METRICS_DEBUG_CONFIG", "true")
+	InitMetrics("hostname", "status")
+
+	uniqueHostnameMap = make(map[string]struct{})
+	uniqueHostnamesOverflowed = false
+	defer func(max int) { maxUniqueHostnames = max }(maxUniqueHostnames)
+	maxUniqueHostnames = 1
+
+	for _, request := range []struct{ hostname, status string }{
+		{"a.foo.com", "200"},
+		{"b.foo.com", "404"},
+		{"a.foo.com", "200"},
+	} {
+		labels := map[string]string{hostnameLabel: request.hostname, "status": request.status, aeeHealthcheckLabel: "false"}
+		addRequest(labels, map[string]string{"status": request.status})
+	}
+
+	recorder = httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, defaultDebugConfigPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var config debugConfig
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &config))
+	assert.Equal(t, debugLabels{
+		LogFieldNames:      []string{"hostname", "status"},
+		SanitizedP8sLabels: []string{"status"},
+		RequestLabels:      []string{"status", aeeHealthcheckLabel},
+	}, config.Labels)
+	assert.Equal(t, map[string]int{"status": 2, aeeHealthcheckLabel: 1}, config.DistinctLabelValues)
+	assert.Equal(t, debugHostnames{
+		Metrics:    true,
+		Max:        1,
+		Count:      1,
+		Overflowed: true,
+		Tracked:    []string{"a.foo.com"},
+	}, config.Hostnames)
+	assert.False(t, config.Geo.Enabled)
+	assert.Nil(t, config.Geo.Adaptive)
+	assert.Equal(t, "truncate", config.OversizedLines)
+	assert.Equal(t, 1, config.Workers)
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const (
+	contentTypeBucketField = "content_type_bucket"
+	uaClassField           = "ua_class"
+	statusClassField       = "status_class"
+	routeField             = "route"
+
+	uaClassHealthcheck = "healthcheck"
+	uaClassBot         = "bot"
+	uaClassBrowser     = "browser"
+	uaClassOther       = "other"
+
+	routeIDSegment = ":id"
+)
+
+var (
+	isEnrichingLogs = false
+
+	// enrichedFields is the order the derived fields are appended to a log line
+	enrichedFields = []string{geoHash, contentTypeBucketField, uaClassField, statusClassField, routeField}
+
+	botUserAgentRegex = regexp.MustCompile(`(?i)bot|crawl|spider|slurp`)
+	idSegmentRegex    = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F-]{16,})$`)
+)
+
+// EnableLogEnrichment makes the reader add the fields it derives (geo_hash, content_type_bucket,
+// ua_class, status_class and route) to each log line written to the output, so log consumers
+// see the same dimensions as the metrics. Fields already present in the log line are not replaced.
+func EnableLogEnrichment() {
+	isEnrichingLogs = true
+}
+
+// deriveFields returns the labels of a log line together with the fields derived from it.
+func deriveFields(labels map[string]string, logline map[string]string) map[string]string {
+	fields := make(map[string]string, len(labels)+len(enrichedFields))
+	for label, value := range labels {
+		fields[label] = value
+	}
+	fields[contentTypeBucketField] = sanitizeLabelValue("content_type", logline["content_type"])
+	fields[uaClassField] = userAgentClass(logline)
+	fields[statusClassField] = statusClass(logline["status"])
+	fields[routeField] = route(logline)
+	return fields
+}
+
+func userAgentClass(logline map[string]string) string {
+	userAgent := extractUserAgent(logline)
+
+	switch {
+	case userAgent == "" || userAgent == "-":
+		return ""
+	case aeeUserAgentRegex.MatchString(userAgent):
+		return uaClassHealthcheck
+	case botUserAgentRegex.MatchString(userAgent):
+		return uaClassBot
+	case strings.HasPrefix(userAgent, "Mozilla/"):
+		return uaClassBrowser
+	default:
+		return uaClassOther
+	}
+}
+
+func statusClass(status string) string {
+	sanitized := sanitizeLabelValue("status", status)
+	if sanitized == "" {
+		return ""
+	}
+	return sanitized[0:1] + "xx"
+}
+
+// route is the request path without the query string and with id-like segments
+// (numbers, uuids, hashes) replaced so it can be aggregated on.
+func route(logline map[string]string) string {
+	var uri string
+	if requestURI, ok := logline["request_uri"]; ok {
+		uri = requestURI
+	} else if request, ok := logline["request"]; ok {
+		// request line, eg "GET /a/path HTTP/1.1"
+		parts := strings.Fields(request)
+		if len(parts) < 2 {
+			return ""
+		}
+		uri = parts[1]
+	}
+
+	uri = strings.SplitN(uri, "?", 2)[0]
+	if !strings.HasPrefix(uri, "/") {
+		return ""
+	}
+
+	segments := strings.Split(uri, "/")
+	for i, segment := range segments {
+		if idSegmentRegex.MatchString(segment) {
+			segments[i] = routeIDSegment
+		}
+	}
+	uri = strings.Join(segments, "/")
+
+	if len(uri) > maxLabelValueLength {
+		uri = uri[0:maxLabelValueLength]
+	}
+	return uri
+}
+
+// appendFields adds the non-empty fields to the end of the JSON object in line, leaving the
+// rest of the line untouched. Fields that already exist in the log line are skipped.
+func appendFields(line []byte, fields map[string]string, logline map[string]string) []byte {
+	end := bytes.LastIndexByte(line, '}')
+	if end < 0 {
+		return line
+	}
+
+	enriched := make([]byte, 0, len(line)+128)
+	enriched = append(enriched, line[:end]...)
+	isEmptyObject := bytes.HasSuffix(bytes.TrimSpace(enriched), []byte("{"))
+
+	for _, name := range enrichedFields {
+		value := fields[name]
+		if value == "" {
+			continue
+		}
+		if _, exists := logline[name]; exists {
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		if !isEmptyObject {
+			enriched = append(enriched, ',')
+		}
+		isEmptyObject = false
+		enriched = append(enriched, `"`+name+`":`...)
+		enriched = append(enriched, encoded...)
+	}
+
+	return append(enriched, line[end:]...)
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgentClass(t *testing.T) {
+	cases := []struct {
+		userAgent string
+		expected  string
+	}{
+		{userAgent: "", expected: ""},
+		{userAgent: "-", expected: ""},
+		{userAgent: "aee/v27", expected: uaClassHealthcheck},
+		{userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", expected: uaClassBot},
+		{userAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/103.0 Safari/537.36", expected: uaClassBrowser},
+		{userAgent: "curl/7.68.0", expected: uaClassOther},
+	}
+	for _, c := range cases {
+		logline := map[string]interface{}{"request": map[string]interface{}{"http_user_agent": c.userAgent}}
+		assert.Equal(t, c.expected, userAgentClass(parseLogLine(logline)), "user agent %q", c.userAgent)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass("200"))
+	assert.Equal(t, "3xx", statusClass(parseLogLine(map[string]interface{}{"status": 304})["status"]))
+	assert.Equal(t, "4xx", statusClass("499"))
+	assert.Equal(t, "5xx", statusClass("503"))
+	assert.Equal(t, "", statusClass("220"))
+	assert.Equal(t, "", statusClass(""))
+}
+
+func TestRoute(t *testing.T) {
+	cases := []struct {
+		logline  map[string]interface{}
+		expected string
+	}{
+		{logline: map[string]interface{}{"request": "GET /a/path HTTP/1.1"}, expected: "/a/path"},
+		{logline: map[string]interface{}{"request": "GET /a/path?token=secret HTTP/1.1"}, expected: "/a/path"},
+		{logline: map[string]interface{}{"request": "GET /users/12345/orders HTTP/1.1"}, expected: "/users/:id/orders"},
+		{logline: map[string]interface{}{"request": "GET /o/123e4567-e89b-12d3-a456-426614174000 HTTP/1.1"}, expected: "/o/:id"},
+		{logline: map[string]interface{}{"request_uri": "/x/y?z=1", "request": "GET /a HTTP/1.1"}, expected: "/x/y"},
+		{logline: map[string]interface{}{"request": "garbage"}, expected: ""},
+		{logline: map[string]interface{}{"request": map[string]interface{}{}}, expected: ""},
+		{logline: map[string]interface{}{}, expected: ""},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, route(parseLogLine(c.logline)), "logline: %+v", c.logline)
+	}
+}
+
+func TestDeriveFields(t *testing.T) {
+	logline := map[string]interface{}{
+		"status":       "404",
+		"content_type": "text/html; charset=utf-8",
+		"request":      "GET /missing HTTP/1.1",
+	}
+
+	fields := deriveFields(map[string]string{}, parseLogLine(logline))
+	assert.Equal(t, map[string]string{
+		contentTypeBucketField: "html",
+		uaClassField:           "",
+		statusClassField:       "4xx",
+		routeField:             "/missing",
+	}, fields)
+
+	fields = deriveFields(map[string]string{geoHash: "r3"}, parseLogLine(logline))
+	assert.Equal(t, "r3", fields[geoHash])
+}
+
+func TestAppendFields(t *testing.T) {
+	fields := map[string]string{
+		geoHash:                "r3",
+		contentTypeBucketField: "html",
+		uaClassField:           "",
+		statusClassField:       "2xx",
+		routeField:             `/a/"quoted"`,
+	}
+
+	actual := appendFields([]byte(`{"status":"200"}`+"\n"), fields, parseLogLine(map[string]interface{}{"status": "200"}))
+	assert.Equal(t, `{"status":"200","geo_hash":"r3","content_type_bucket":"html","status_class":"2xx","route":"/a/\"quoted\""}`+"\n", string(actual))
+
+	actual = appendFields([]byte(`{"status_class":"custom"}`), fields, parseLogLine(map[string]interface{}{"status_class": "custom"}))
+	assert.Equal(t, `{"status_class":"custom","geo_hash":"r3","content_type_bucket":"html","route":"/a/\"quoted\""}`, string(actual))
+
+	actual = appendFields([]byte(`{ }`), map[string]string{statusClassField: "2xx"}, parseLogLine(map[string]interface{}{}))
+	assert.Equal(t, `{ "status_class":"2xx"}`, string(actual))
+
+	actual = appendFields([]byte(`not json`), fields, nil)
+	assert.Equal(t, `not json`, string(actual))
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const requestTimeField = "request_time"
+
+// exemplarFields are the log line fields linking a request to its trace, in order of preference.
+var exemplarFields = []string{"trace_id", "request_id"}
+
+// requestExemplar returns the exemplar labels of the log line, nil when it has no trace or
+// request id or the id is too long for an exemplar.
+func requestExemplar(logline map[string]string) prometheus.Labels {
+	for _, field := range exemplarFields {
+		value := logline[field]
+		if value == "" {
+			continue
+		}
+		if !utf8.ValidString(value) || utf8.RuneCountInString(field)+utf8.RuneCountInString(value) > prometheus.ExemplarMaxRunes {
+			return nil
+		}
+		return prometheus.Labels{field: value}
+	}
+	return nil
+}
+
+// requestDuration returns the request_time of the log line in seconds.
+func requestDuration(logline map[string]string) (float64, bool) {
+	value, ok := logline[requestTimeField]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return seconds, true
+}
+
+// addWithExemplar adds the value to the counter, attaching the exemplar if there is one.
+func addWithExemplar(counter prometheus.Counter, value float64, exemplar prometheus.Labels) {
+	if exemplar == nil {
+		counter.Add(value)
+		return
+	}
+	counter.(prometheus.ExemplarAdder).AddWithExemplar(value, exemplar)
+}
+
+// observeWithExemplar observes the value, attaching the exemplar if there is one.
+func observeWithExemplar(observer prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if exemplar == nil {
+		observer.Observe(value)
+		return
+	}
+	observer.(prometheus.ExemplarObserver).ObserveWithExemplar(value, exemplar)
+}
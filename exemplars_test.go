@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatherOpenMetrics returns the metrics in the OpenMetrics format, which has the exemplars.
+func gatherOpenMetrics(t *testing.T) string {
+	req := httptest.NewRequest(http.MethodGet, defaultMetricsPath, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/openmetrics-text"))
+	return recorder.Body.String()
+}
+
+func TestRequestExemplar(t *testing.T) {
+	assert.Nil(t, requestExemplar(map[string]string{}))
+	assert.Equal(t, prometheus.Labels{"trace_id": "abc"}, requestExemplar(map[string]string{"trace_id": "abc", "request_id": "123"}))
+	assert.Equal(t, prometheus.Labels{"request_id": "123"}, requestExemplar(map[string]string{"request_id": "123"}))
+	assert.Nil(t, requestExemplar(map[string]string{"trace_id": strings.Repeat("a", prometheus.ExemplarMaxRunes)}))
+
+	duration, ok := requestDuration(map[string]string{"request_time": "0.250"})
+	assert.True(t, ok)
+	assert.Equal(t, 0.25, duration)
+	_, ok = requestDuration(map[string]string{"request_time": "-"})
+	assert.False(t, ok)
+	_, ok = requestDuration(map[string]string{})
+	assert.False(t, ok)
+}
+
+func TestOpenMetricsExemplars(t *testing.T) {
+	defer func() { serverDisabled = false }()
+	DisableServer()
+	t.Setenv("MODULE_METRICS_REQUEST_HISTOGRAMS", "true")
+	InitMetrics("hostname", "status")
+
+	r := &reader{source: defaultSource, parser: JSONParser, output: io.Discard, errorWriter: io.Discard}
+	r.processLine([]byte(`{"hostname":"www.foo.com","status":200,"bytes":10,"request_time":"0.042","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"}` + "\n"))
+	r.processLine([]byte(`{"hostname":"www.foo.com","status":200,"bytes":10,"request_time":"3.5","request_id":"req-1"}` + "\n"))
+	r.processLine([]byte(`{"hostname":"www.foo.com","status":404,"bytes":10}` + "\n"))
+
+	actual := gatherOpenMetrics(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="200"} 2.0 # {request_id="req-1"} 1.0 `)
+	assert.Contains(t, actual, `section_http_request_count_by_hostname_total{hostname="www.foo.com"} 3.0 # {request_id="req-1"} 1.0 `)
+	assert.Contains(t, actual, `section_http_request_duration_seconds_bucket{status="200",le="0.05"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.042 `)
+	assert.Contains(t, actual, `section_http_request_duration_seconds_bucket{status="200",le="5.0"} 2 # {request_id="req-1"} 3.5 `)
+	assert.Contains(t, actual, `section_http_request_duration_seconds_count{status="200"} 2`)
+	assert.NotContains(t, actual, `section_http_request_duration_seconds_count{status="404"}`)
+	assert.Contains(t, actual, "# EOF\n")
+
+	// the classic text format is still the default
+	assert.NotContains(t, gatherP8sResponse(t), "# {")
+}
@@ -0,0 +1,484 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// fieldPaths is a tree of the dotted paths of the fields extracted from a JSON log line.
+type fieldPaths map[string]*fieldPath
+
+type fieldPath struct {
+	path       string
+	wanted     bool
+	stringOnly bool
+	// literal is a dotted path matched as a key of its own, it takes precedence over the nested one
+	literal  bool
+	children fieldPaths
+}
+
+// staticFieldPaths are the fields always extracted, besides the additional labels.
+var staticFieldPaths = []string{
+	"bytes", "bytes_sent", "status", "content_type",
+	"request", userAgentField, "request_uri",
+	"geo", geoLatLonField, geoHash,
+	contentTypeBucketField, uaClassField, statusClassField, routeField,
+	requestTimeField, "trace_id", "request_id",
+}
+
+// stringFieldPaths are only extracted when their value is a string.
+var stringFieldPaths = map[string]bool{
+	"request":      true,
+	userAgentField: true,
+	"request_uri":  true,
+}
+
+const (
+	userAgentField = "request.http_user_agent"
+	geoLatLonField = "geo." + geoLatLon
+)
+
+var (
+	extractedFields = compileFieldPaths(staticFieldPaths)
+	jsonLiterals    = [][]byte{[]byte("true"), []byte("false"), []byte("null")}
+)
+
+func compileFieldPaths(paths []string) fieldPaths {
+	root := fieldPaths{}
+	for _, path := range paths {
+		level := root
+		keys := strings.Split(path, ".")
+		for i, key := range keys {
+			node, ok := level[key]
+			if !ok {
+				node = &fieldPath{path: strings.Join(keys[:i+1], ".")}
+				node.stringOnly = stringFieldPaths[node.path]
+				level[key] = node
+			}
+			if i == len(keys)-1 {
+				node.wanted = true
+			} else {
+				if node.children == nil {
+					node.children = fieldPaths{}
+				}
+				level = node.children
+			}
+		}
+	}
+	return root
+}
+
+// addLiteralFieldPaths also matches the dotted paths as keys of their own, eg a label
+// "upstream.status" is taken from {"upstream.status":"200"} as well as {"upstream":{"status":"200"}}.
+func addLiteralFieldPaths(root fieldPaths, paths []string) {
+	for _, path := range paths {
+		if !strings.Contains(path, ".") {
+			continue
+		}
+		root[path] = &fieldPath{path: path, wanted: true, stringOnly: stringFieldPaths[path], literal: true}
+	}
+}
+
+// setExtractedFields sets the fields JSONParser extracts to the static ones and the labels.
+func setExtractedFields(labels []string) {
+	paths := compileFieldPaths(append(append([]string{}, staticFieldPaths...), labels...))
+	addLiteralFieldPaths(paths, labels)
+	extractedFields = paths
+}
+
+// extractFields scans the JSON object in the line once, returning the wanted fields keyed by
+// their dotted path. String values are unescaped, other values are kept as their JSON text unless
+// the field is string only and null values are left out. Everything else is skipped without
+// being decoded.
+func extractFields(line []byte, paths fieldPaths) (map[string]string, error) {
+	s := &fieldScanner{line: line}
+	s.skipSpace()
+	if s.pos == len(line) {
+		return nil, &parseError{reason: parseErrorEmptyLine, offset: s.pos, message: "empty log line"}
+	}
+	if line[s.pos] != '{' {
+		return nil, &parseError{reason: parseErrorNotAnObject, offset: s.pos, message: "log line is not a JSON object"}
+	}
+
+	fields := make(map[string]string, 8)
+	err := s.object(paths, fields)
+	if err != nil {
+		return nil, err
+	}
+	s.skipSpace()
+	if s.pos != len(line) {
+		return nil, s.errorf("invalid character %q after top-level value", line[s.pos])
+	}
+	return fields, nil
+}
+
+type fieldScanner struct {
+	line []byte
+	pos  int
+	// the literal dotted keys found, see addLiteralFieldPaths
+	literals map[string]struct{}
+}
+
+func (s *fieldScanner) errorf(format string, args ...interface{}) error {
+	return &parseError{reason: parseErrorSyntax, offset: s.pos, message: fmt.Sprintf(format, args...)}
+}
+
+func (s *fieldScanner) skipSpace() {
+	for s.pos < len(s.line) {
+		switch s.line[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *fieldScanner) expect(c byte) error {
+	s.skipSpace()
+	if s.pos == len(s.line) {
+		return s.errorf("unexpected end of JSON input")
+	}
+	if s.line[s.pos] != c {
+		return s.errorf("invalid character %q looking for %q", s.line[s.pos], c)
+	}
+	s.pos++
+	return nil
+}
+
+// object scans the object starting at the current position, adding the wanted fields.
+func (s *fieldScanner) object(paths fieldPaths, fields map[string]string) error {
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	s.skipSpace()
+	if s.pos < len(s.line) && s.line[s.pos] == '}' {
+		s.pos++
+		return nil
+	}
+
+	for {
+		s.skipSpace()
+		if s.pos == len(s.line) || s.line[s.pos] != '"' {
+			return s.errorf("invalid character looking for beginning of object key string")
+		}
+		key, escaped, err := s.str()
+		if err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		s.skipSpace()
+
+		var node *fieldPath
+		if paths != nil {
+			if escaped {
+				node = paths[unescape(key)]
+			} else {
+				node = paths[string(key)]
+			}
+		}
+		if node == nil {
+			err = s.skipValue()
+		} else {
+			err = s.value(node, fields)
+		}
+		if err != nil {
+			return err
+		}
+
+		s.skipSpace()
+		if s.pos == len(s.line) {
+			return s.errorf("unexpected end of JSON input")
+		}
+		switch s.line[s.pos] {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("invalid character %q after object key:value pair", s.line[s.pos])
+		}
+	}
+}
+
+// value scans a value of a wanted field or of an object holding wanted fields.
+func (s *fieldScanner) value(node *fieldPath, fields map[string]string) error {
+	if s.pos == len(s.line) {
+		return s.errorf("unexpected end of JSON input")
+	}
+	start := s.pos
+
+	switch s.line[s.pos] {
+	case '"':
+		value, escaped, err := s.str()
+		if err != nil {
+			return err
+		}
+		if !node.wanted {
+			return nil
+		}
+		if escaped {
+			s.set(node, fields, unescape(value))
+		} else {
+			s.set(node, fields, string(value))
+		}
+		return nil
+	case '{':
+		var err error
+		if node.children != nil {
+			err = s.object(node.children, fields)
+		} else {
+			err = s.skipValue()
+		}
+		if err != nil {
+			return err
+		}
+	case 'n':
+		return s.skipValue()
+	default:
+		if err := s.skipValue(); err != nil {
+			return err
+		}
+	}
+
+	if node.wanted && !node.stringOnly {
+		s.set(node, fields, string(s.line[start:s.pos]))
+	}
+	return nil
+}
+
+// set adds the value of the field, unless it's nested and the literal key has been found.
+func (s *fieldScanner) set(node *fieldPath, fields map[string]string, value string) {
+	if node.literal {
+		if s.literals == nil {
+			s.literals = map[string]struct{}{}
+		}
+		s.literals[node.path] = struct{}{}
+	} else if _, ok := s.literals[node.path]; ok {
+		return
+	}
+	fields[node.path] = value
+}
+
+// str scans a string, returning its content without the quotes and whether it has escapes.
+func (s *fieldScanner) str() ([]byte, bool, error) {
+	s.pos++
+	start := s.pos
+	escaped := false
+	for s.pos < len(s.line) {
+		switch c := s.line[s.pos]; {
+		case c == '"':
+			s.pos++
+			return s.line[start : s.pos-1], escaped, nil
+		case c == '\\':
+			escaped = true
+			if err := s.escape(); err != nil {
+				return nil, false, err
+			}
+		case c < 0x20:
+			return nil, false, s.errorf("invalid character %q in string literal", c)
+		default:
+			s.pos++
+		}
+	}
+	return nil, false, s.errorf("unexpected end of JSON input")
+}
+
+// escape scans an escape sequence in a string.
+func (s *fieldScanner) escape() error {
+	s.pos++
+	if s.pos == len(s.line) {
+		return s.errorf("unexpected end of JSON input")
+	}
+	switch c := s.line[s.pos]; c {
+	case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		s.pos++
+		return nil
+	case 'u':
+		s.pos++
+		for i := 0; i < 4; i++ {
+			if s.pos == len(s.line) {
+				return s.errorf("unexpected end of JSON input")
+			}
+			if !isHexDigit(s.line[s.pos]) {
+				return s.errorf("invalid character %q in \\u hexadecimal character escape", s.line[s.pos])
+			}
+			s.pos++
+		}
+		return nil
+	default:
+		return s.errorf("invalid character %q in string escape code", c)
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// number scans a number: an optional minus, an integer without leading zeros and an optional
+// fraction and exponent.
+func (s *fieldScanner) number() error {
+	if s.line[s.pos] == '-' {
+		s.pos++
+	}
+	switch {
+	case s.pos == len(s.line):
+		return s.errorf("unexpected end of JSON input")
+	case s.line[s.pos] == '0':
+		s.pos++
+	case isDigit(s.line[s.pos]):
+		s.digits()
+	default:
+		return s.errorf("invalid character %q in numeric literal", s.line[s.pos])
+	}
+
+	if s.pos < len(s.line) && s.line[s.pos] == '.' {
+		s.pos++
+		if err := s.requireDigits(); err != nil {
+			return err
+		}
+	}
+	if s.pos < len(s.line) && (s.line[s.pos] == 'e' || s.line[s.pos] == 'E') {
+		s.pos++
+		if s.pos < len(s.line) && (s.line[s.pos] == '+' || s.line[s.pos] == '-') {
+			s.pos++
+		}
+		if err := s.requireDigits(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fieldScanner) digits() {
+	for s.pos < len(s.line) && isDigit(s.line[s.pos]) {
+		s.pos++
+	}
+}
+
+func (s *fieldScanner) requireDigits() error {
+	if s.pos == len(s.line) {
+		return s.errorf("unexpected end of JSON input")
+	}
+	if !isDigit(s.line[s.pos]) {
+		return s.errorf("invalid character %q in numeric literal", s.line[s.pos])
+	}
+	s.digits()
+	return nil
+}
+
+// skipValue scans past a value without decoding it.
+func (s *fieldScanner) skipValue() error {
+	if s.pos == len(s.line) {
+		return s.errorf("unexpected end of JSON input")
+	}
+
+	switch c := s.line[s.pos]; {
+	case c == '"':
+		_, _, err := s.str()
+		return err
+	case c == '{':
+		return s.object(nil, nil)
+	case c == '[':
+		s.pos++
+		s.skipSpace()
+		if s.pos < len(s.line) && s.line[s.pos] == ']' {
+			s.pos++
+			return nil
+		}
+		for {
+			s.skipSpace()
+			if err := s.skipValue(); err != nil {
+				return err
+			}
+			s.skipSpace()
+			if s.pos == len(s.line) {
+				return s.errorf("unexpected end of JSON input")
+			}
+			switch s.line[s.pos] {
+			case ',':
+				s.pos++
+			case ']':
+				s.pos++
+				return nil
+			default:
+				return s.errorf("invalid character %q after array element", s.line[s.pos])
+			}
+		}
+	case c == '-' || isDigit(c):
+		return s.number()
+	default:
+		for _, literal := range jsonLiterals {
+			if bytes.HasPrefix(s.line[s.pos:], literal) {
+				s.pos += len(literal)
+				return nil
+			}
+		}
+		return s.errorf("invalid character %q looking for beginning of value", c)
+	}
+}
+
+// unescape decodes the escape sequences of a JSON string, the string has already been scanned.
+func unescape(value []byte) string {
+	var b strings.Builder
+	b.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, n := unescapeRune(value[i+1:])
+			b.WriteRune(r)
+			i += n
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapeRune decodes the hex digits of a \u escape, combining a surrogate pair.
+func unescapeRune(value []byte) (rune, int) {
+	if len(value) < 4 {
+		return utf8.RuneError, 0
+	}
+	r1, err := strconv.ParseUint(string(value[:4]), 16, 16)
+	if err != nil {
+		return utf8.RuneError, 0
+	}
+	if !utf16.IsSurrogate(rune(r1)) {
+		return rune(r1), 4
+	}
+	if len(value) >= 10 && value[4] == '\\' && value[5] == 'u' {
+		if r2, err := strconv.ParseUint(string(value[6:10]), 16, 16); err == nil {
+			if r := utf16.DecodeRune(rune(r1), rune(r2)); r != utf8.RuneError {
+				return r, 10
+			}
+		}
+	}
+	return utf8.RuneError, 4
+}
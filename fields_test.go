@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractFields(t *testing.T) {
+	paths := compileFieldPaths([]string{"status", "bytes", "upstream", "request", userAgentField, "geo.latlon", "tags", "escaped\nkey"})
+
+	cases := []struct {
+		line     string
+		expected map[string]string
+	}{
+		{`{"status":"200","other":"ignored"}`, map[string]string{"status": "200"}},
+		{` { "status" : 200 , "bytes" : -1.5e3 } ` + "\n", map[string]string{"status": "200", "bytes": "-1.5e3"}},
+		{`{"status":true,"bytes":null}`, map[string]string{"status": "true"}},
+		{`{"status":"a\"b\\c\/d\né😀"}`, map[string]string{"status": "a\"b\\c/d\né😀"}},
+		{`{"escaped\nkey":"x"}`, map[string]string{"escaped\nkey": "x"}},
+		{`{"request":{"http_user_agent":"Mozilla/5.0","other":{"a":[1,{"b":2}]}}}`, map[string]string{userAgentField: "Mozilla/5.0"}},
+		{`{"request":"GET / HTTP/1.1"}`, map[string]string{"request": "GET / HTTP/1.1"}},
+		{`{"request":{"http_user_agent":13}}`, map[string]string{}},
+		{`{"upstream":{"addr":"a"},"tags":["a","b"]}`, map[string]string{"upstream": `{"addr":"a"}`, "tags": `["a","b"]`}},
+		{`{"geo":{"latlon":"1.1,2.2"},"status":"200","status":"304"}`, map[string]string{"geo.latlon": "1.1,2.2", "status": "304"}},
+		{`{}`, map[string]string{}},
+		{`{"nested":{"deeply":[[[]],{}]},"e":[]}`, map[string]string{}},
+	}
+
+	for _, c := range cases {
+		fields, err := extractFields([]byte(c.line), paths)
+		assert.NoError(t, err, c.line)
+		assert.Equal(t, c.expected, fields, c.line)
+	}
+}
+
+func TestExtractFieldsErrors(t *testing.T) {
+	lines := []string{
+		``,
+		" \n",
+		`null`,
+		`["status"]`,
+		`"status"`,
+		`{"status":"200"`,
+		`{"status":"200",}`,
+		`{"status" "200"}`,
+		`{status:"200"}`,
+		`{"status":"200"} trailing`,
+		`{"status":"2` + "\n" + `00"}`,
+		`{"other":[1,2}`,
+		`{"other":nope}`,
+		`{"other":-}`,
+		`{"other":"unterminated\"}`,
+		`{"other":"\x00"}`,
+		`{"other":"\a"}`,
+		`{"other":"\u12"}`,
+		`{"other":"\u12g4"}`,
+		`{"other":"\`,
+		`{"other":01}`,
+		`{"other":1-2}`,
+		`{"other":1.}`,
+		`{"other":.5}`,
+		`{"other":1e}`,
+		`{"other":1e+}`,
+		`{"other":-a}`,
+		`{"other":+1}`,
+		`{"other":[1,2e5,-0.5e-3,00]}`,
+		`{"other":truex}`,
+	}
+
+	for _, line := range lines {
+		_, err := extractFields([]byte(line), extractedFields)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestExtractFieldsValidJSON(t *testing.T) {
+	lines := []string{
+		`{"other":"\"\\\/\b\f\n\r\t\u00e9\uD83D\uDE00"}`,
+		`{"other":[0,-0,1,-12,0.5,1e5,1E+5,-1.25e-3,10.0E2]}`,
+		`{"other":[true,false,null,{},[]]}`,
+	}
+
+	for _, line := range lines {
+		_, err := extractFields([]byte(line), extractedFields)
+		assert.NoError(t, err, line)
+	}
+}
+
+func TestSetExtractedFields(t *testing.T) {
+	defer setExtractedFields(nil)
+
+	setExtractedFields([]string{"upstream_status"})
+	fields, err := JSONParser([]byte(`{"upstream_status":"502","upstream_addr":"198.51.100.1:443"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"upstream_status": "502"}, fields)
+}
+
+func TestSetExtractedFieldsDottedLabels(t *testing.T) {
+	defer setExtractedFields(nil)
+
+	setExtractedFields([]string{"upstream.status"})
+
+	fields, err := JSONParser([]byte(`{"upstream.status":"502"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"upstream.status": "502"}, fields)
+
+	fields, err = JSONParser([]byte(`{"upstream":{"status":"504"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"upstream.status": "504"}, fields)
+
+	// the literal key wins wherever it is
+	for _, line := range []string{
+		`{"upstream.status":"502","upstream":{"status":"504"}}`,
+		`{"upstream":{"status":"504"},"upstream.status":"502"}`,
+	} {
+		fields, err = JSONParser([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"upstream.status": "502"}, fields, line)
+	}
+
+	// only the labels are matched literally
+	fields, err = JSONParser([]byte(`{"request.http_user_agent":"curl"}`))
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+}
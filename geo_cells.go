@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/mmcloughlin/geohash"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultGeoCellsPath = "/geo/cells"
+
+// geoCell is a 'geo_hash' label value decoded to coordinates so dashboards
+// (eg Grafana geomap panels) can join on it.
+type geoCell struct {
+	GeoHash  string  `json:"geo_hash"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	MinLat   float64 `json:"min_lat"`
+	MaxLat   float64 `json:"max_lat"`
+	MinLon   float64 `json:"min_lon"`
+	MaxLon   float64 `json:"max_lon"`
+	Requests float64 `json:"requests"`
+}
+
+// activeGeoCells returns every valid 'geo_hash' label value currently exported on the
+// request counter, with the total requests counted for it.
+func activeGeoCells() ([]geoCell, error) {
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	requestsName := prometheus.BuildFQName(promeNamespace, promeSubsystem, "request_count_total")
+	requests := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != requestsName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == geoHash {
+					requests[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	cells := []geoCell{}
+	for hash, count := range requests {
+		// skips the 'missing' and 'overflow' placeholders
+		if geohash.Validate(hash) != nil {
+			continue
+		}
+		box := geohash.BoundingBox(hash)
+		lat, lon := box.Center()
+		cells = append(cells, geoCell{
+			GeoHash:  hash,
+			Lat:      lat,
+			Lon:      lon,
+			MinLat:   box.MinLat,
+			MaxLat:   box.MaxLat,
+			MinLon:   box.MinLng,
+			MaxLon:   box.MaxLng,
+			Requests: count,
+		})
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].GeoHash < cells[j].GeoHash })
+
+	return cells, nil
+}
+
+func geoCellsHandler(w http.ResponseWriter, _ *http.Request) {
+	cells, err := activeGeoCells()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cells)
+}
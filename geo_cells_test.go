@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoCellsHandler(t *testing.T) {
+	isGeoHashing = true
+	defer func() { isGeoHashing = false }()
+
+	InitMetrics()
+
+	logline := map[string]interface{}{"status": "200"}
+	addRequest(map[string]string{aeeHealthcheckLabel: "false", geoHash: "r3"}, parseLogLine(logline))
+	addRequest(map[string]string{aeeHealthcheckLabel: "true", geoHash: "r3"}, parseLogLine(logline))
+	addRequest(map[string]string{aeeHealthcheckLabel: "false", geoHash: "gc"}, parseLogLine(logline))
+	addRequest(map[string]string{aeeHealthcheckLabel: "false", geoHash: geoMissing}, parseLogLine(logline))
+
+	recorder := httptest.NewRecorder()
+	geoCellsHandler(recorder, httptest.NewRequest(http.MethodGet, defaultGeoCellsPath, nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var cells []geoCell
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &cells))
+	assert.Len(t, cells, 2)
+
+	assert.Equal(t, "gc", cells[0].GeoHash)
+	assert.Equal(t, float64(1), cells[0].Requests)
+
+	assert.Equal(t, "r3", cells[1].GeoHash)
+	assert.Equal(t, float64(2), cells[1].Requests)
+	assert.InDelta(t, -36.5625, cells[1].Lat, 0.0001)
+	assert.InDelta(t, 151.875, cells[1].Lon, 0.0001)
+	assert.True(t, cells[1].MinLat < cells[1].Lat && cells[1].Lat < cells[1].MaxLat)
+	assert.True(t, cells[1].MinLon < cells[1].Lon && cells[1].Lon < cells[1].MaxLon)
+}
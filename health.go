@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthzPath = "/healthz"
+	defaultReadyzPath  = "/readyz"
+)
+
+// The states of a reader, as checked by /readyz.
+const (
+	readerStopped int32 = iota
+	readerOpen
+	readerReopening
+)
+
+var (
+	readersMu sync.Mutex
+	readers   []*reader
+
+	// readyMaxIdle is how long /readyz tolerates no log lines being read, 0 disables the check.
+	readyMaxIdle time.Duration
+)
+
+// trackReader adds the reader to the ones checked by /readyz.
+func trackReader(r *reader) {
+	r.started = time.Now()
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	readers = append(readers, r)
+}
+
+// resetReaders forgets the readers tracked so far, when SetupInputs sets up the inputs again.
+func resetReaders() {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	readers = nil
+}
+
+// setupReadiness applies MODULE_METRICS_READY_MAX_IDLE, eg "10m".
+func setupReadiness() {
+	readyMaxIdle = 0
+	if maxIdleStr := os.Getenv("MODULE_METRICS_READY_MAX_IDLE"); maxIdleStr != "" {
+		maxIdle, err := time.ParseDuration(maxIdleStr)
+		if err == nil && maxIdle > 0 {
+			readyMaxIdle = maxIdle
+		}
+	}
+}
+
+// readinessProblems returns why the module isn't ready, nothing when it is.
+func readinessProblems(now time.Time) []string {
+	var problems []string
+	if registry == nil {
+		problems = append(problems, "metrics registry is not registered")
+	}
+
+	readersMu.Lock()
+	defer readersMu.Unlock()
+	if len(readers) == 0 {
+		problems = append(problems, "no input has been started")
+		return problems
+	}
+
+	var lastLine time.Time
+	for _, r := range readers {
+		switch r.state.Load() {
+		case readerStopped:
+			problems = append(problems, fmt.Sprintf("reader of input %s has stopped", r.source))
+		case readerReopening:
+			problems = append(problems, fmt.Sprintf("input %s is being reopened", r.source))
+		}
+		last := r.started
+		if nanos := r.lastLine.Load(); nanos > 0 {
+			last = time.Unix(0, nanos)
+		}
+		if last.After(lastLine) {
+			lastLine = last
+		}
+	}
+
+	if readyMaxIdle > 0 && now.Sub(lastLine) > readyMaxIdle {
+		problems = append(problems, fmt.Sprintf("no log lines read for %s", now.Sub(lastLine).Truncate(time.Second)))
+	}
+	return problems
+}
+
+// healthzHandler reports the process is alive.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether the inputs are open, their readers running and, if
+// MODULE_METRICS_READY_MAX_IDLE is set, whether log lines are still being read.
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	problems := readinessProblems(time.Now())
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
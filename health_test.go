@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readyz(t *testing.T) (int, string) {
+	recorder := httptest.NewRecorder()
+	readyzHandler(recorder, httptest.NewRequest(http.MethodGet, defaultReadyzPath, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHealthz(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, defaultHealthzPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ok\n", recorder.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	InitMetrics()
+	resetReaders()
+
+	code, body := readyz(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "no input has been started\n", body)
+
+	access := &reader{source: "access"}
+	errorLog := &reader{source: "error"}
+	trackReader(access)
+	trackReader(errorLog)
+	access.state.Store(readerOpen)
+	errorLog.state.Store(readerReopening)
+
+	code, body = readyz(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "input error is being reopened\n", body)
+
+	errorLog.state.Store(readerOpen)
+	code, body = readyz(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	// the readers started before are still checked after InitMetrics
+	InitMetrics()
+	code, body = readyz(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok\n", body)
+
+	access.state.Store(readerStopped)
+	code, body = readyz(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "reader of input access has stopped\n", body)
+}
+
+func TestReadyzMaxIdle(t *testing.T) {
+	defer setupReadiness()
+	os.Setenv("MODULE_METRICS_READY_MAX_IDLE", "5m")
+	defer os.Unsetenv("MODULE_METRICS_READY_MAX_IDLE")
+	InitMetrics()
+	resetReaders()
+
+	r := &reader{source: "access"}
+	trackReader(r)
+	r.state.Store(readerOpen)
+	now := time.Now()
+
+	assert.Empty(t, readinessProblems(now.Add(4*time.Minute)))
+	assert.Equal(t, []string{"no log lines read for 6m0s"}, readinessProblems(now.Add(6*time.Minute)))
+
+	r.lastLine.Store(now.Add(3 * time.Minute).UnixNano())
+	assert.Empty(t, readinessProblems(now.Add(6*time.Minute)))
+}
@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	sourceLabel   = "source"
+	defaultSource = "default"
+)
+
+var (
+	includeSourceLabel = false
+
+	// the AsyncWriter wrapping stdout, created by the first SetupInputs with a buffer
+	outputWriter *AsyncWriter
+)
+
+// InputKind is the kind of file an Input reads its log lines from.
+type InputKind int
+
+const (
+	// InputFIFO is a FIFO file created by SetupInputs that the module writes its logs to.
+	InputFIFO InputKind = iota
+	// InputTail is a regular log file that is followed across rotations, like `tail -F`.
+	InputTail
+	// InputSyslog is a syslog server receiving RFC 5424 or RFC 3164 messages.
+	InputSyslog
+)
+
+// Parser turns a log line into its fields, returning an error if the line can't be parsed. The
+// fields of nested objects are keyed by their dotted path, eg "request.http_user_agent".
+type Parser func(line []byte) (map[string]string, error)
+
+// JSONParser parses a log line holding a JSON object, it is the default Parser. Only the fields
+// used for the metrics are extracted, in a single pass over the line.
+func JSONParser(line []byte) (map[string]string, error) {
+	logline, err := extractFields(line, extractedFields)
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON parsing failed")
+	}
+	return logline, nil
+}
+
+// RegexParser returns a Parser for plain text log lines, eg error logs, the named
+// groups of the expression become the fields of the log line.
+func RegexParser(expr *regexp.Regexp) Parser {
+	return func(line []byte) (map[string]string, error) {
+		match := expr.FindSubmatch(line)
+		if match == nil {
+			return nil, errors.Errorf("log line does not match %s", expr)
+		}
+		logline := map[string]string{}
+		for i, name := range expr.SubexpNames() {
+			if name != "" {
+				logline[name] = string(match[i])
+			}
+		}
+		return logline, nil
+	}
+}
+
+// Input is a file the module writes its logs to. All inputs feed the same registry, when
+// there is more than one input the metrics get a 'source' label identifying the input.
+type Input struct {
+	// Kind of the file, defaults to InputFIFO.
+	Kind InputKind
+	// Path of the file, a FIFO file is created by SetupInputs.
+	Path string
+	// StateFile is where an InputTail persists its offset across restarts. Without one, or on
+	// the first start, the file is followed from its end.
+	StateFile string
+	// Network of an InputSyslog, "udp", "tcp", "unix" or "unixgram".
+	Network string
+	// Address an InputSyslog listens on, eg "127.0.0.1:514" or the path of a unix socket.
+	Address string
+	// Tag selects the messages of an InputSyslog when several inputs share the same Network
+	// and Address, an input without a Tag receives the messages no other input matches.
+	Tag string
+	// Source is the value of the 'source' label, it defaults to the file name of Path, or the
+	// Tag or "syslog" for an InputSyslog.
+	Source string
+	// Labels are the additional labels taken from the log lines of this input. Labels of
+	// other inputs are left blank on this input's metrics.
+	Labels []string
+	// Parser parses the log lines, it defaults to JSONParser.
+	Parser Parser
+}
+
+// SetupInputs is like SetupModule for several files: it starts the Prometheus server, creates
+// & opens each of them and starts a reader per input. The log lines of all the inputs
+// are written to stdout.
+func SetupInputs(stdout io.Writer, stderr io.Writer, inputs ...Input) error {
+	if len(inputs) == 0 {
+		return errors.New("SetupInputs requires at least one input")
+	}
+
+	var labels []string
+	sources := map[string]struct{}{}
+	syslogTags := map[string]struct{}{}
+	for i := range inputs {
+		if inputs[i].Source == "" {
+			inputs[i].Source = defaultInputSource(inputs[i])
+		}
+		if _, ok := sources[inputs[i].Source]; ok {
+			return errors.Errorf("input source %s is not unique", inputs[i].Source)
+		}
+		sources[inputs[i].Source] = struct{}{}
+
+		if inputs[i].Kind == InputSyslog {
+			key := inputs[i].Network + " " + inputs[i].Address + " " + inputs[i].Tag
+			if _, ok := syslogTags[key]; ok {
+				return errors.Errorf("syslog tag %q on %s %s is not unique",
+					inputs[i].Tag, inputs[i].Network, inputs[i].Address)
+			}
+			syslogTags[key] = struct{}{}
+		}
+
+		for _, label := range inputs[i].Labels {
+			if !slices.Contains(labels, label) {
+				labels = append(labels, label)
+			}
+		}
+	}
+
+	if envBool("MODULE_METRICS_ENRICH_LOGS") {
+		EnableLogEnrichment()
+	}
+
+	stdout, err := setupOutput(stdout)
+	if err != nil {
+		return err
+	}
+
+	err = setupMaxLineLength()
+	if err != nil {
+		return err
+	}
+
+	err = setupWorkers()
+	if err != nil {
+		return err
+	}
+
+	// start the server before creating the inputs, so they aren't left without a reader
+	includeSourceLabel = len(inputs) > 1
+	InitMetrics(labels...)
+	if serverErr != nil {
+		return serverErr
+	}
+
+	err = StartRemoteWrite()
+	if err != nil {
+		return err
+	}
+
+	// the files of a previous setup are tailed from the saved state by the new tailers
+	closeTailers()
+	// free the addresses the new listeners listen on
+	closeSyslogListeners()
+	resetReaders()
+
+	files, listeners, err := openInputs(inputs, stderr)
+	if err != nil {
+		return err
+	}
+
+	for i, input := range inputs {
+		r := &reader{
+			source:      input.Source,
+			path:        input.Path,
+			reopen:      reopenReadFifo,
+			labels:      map[string]struct{}{},
+			parser:      input.Parser,
+			output:      stdout,
+			errorWriter: stderr,
+		}
+		for _, label := range input.Labels {
+			r.labels[label] = struct{}{}
+		}
+		if r.parser == nil {
+			r.parser = JSONParser
+		}
+		switch input.Kind {
+		case InputSyslog:
+			listeners[input.Network+" "+input.Address].route(input.Tag, r)
+			continue
+		case InputTail:
+			r.reopen = nil
+		}
+		r.start(files[i])
+	}
+
+	for _, listener := range listeners {
+		trackSyslogListener(listener)
+		listener.start()
+	}
+
+	return nil
+}
+
+// openInputs creates & opens the files and listens on the syslog addresses of the inputs,
+// closing the ones already opened when one fails.
+func openInputs(inputs []Input, stderr io.Writer) ([]io.ReadCloser, map[string]*syslogListener, error) {
+	files := make([]io.ReadCloser, len(inputs))
+	listeners := map[string]*syslogListener{}
+	closeAll := func() {
+		for i, file := range files {
+			if file == nil {
+				continue
+			}
+			_ = file.Close()
+			if inputs[i].Kind == InputFIFO {
+				closeWriteFifo(inputs[i].Path)
+			}
+		}
+		for _, listener := range listeners {
+			listener.close()
+		}
+	}
+
+	for i, input := range inputs {
+		if input.Kind == InputSyslog {
+			key := input.Network + " " + input.Address
+			if _, ok := listeners[key]; ok {
+				continue
+			}
+			listener, err := listenSyslog(input.Network, input.Address, stderr)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			listeners[key] = listener
+			continue
+		}
+
+		if input.Kind == InputTail {
+			tailer, err := newFileTailer(input.Path, input.StateFile, stderr)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			trackTailer(tailer)
+			files[i] = tailer
+			continue
+		}
+
+		err := CreateLogFifo(input.Path)
+		if err == nil {
+			files[i], err = OpenReadFifo(input.Path)
+		}
+		if err == nil {
+			err = OpenWriteFifo(input.Path)
+		}
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+	}
+
+	return files, listeners, nil
+}
+
+func defaultInputSource(input Input) string {
+	if input.Kind != InputSyslog {
+		return path.Base(input.Path)
+	}
+	if input.Tag != "" {
+		return input.Tag
+	}
+	return "syslog"
+}
+
+// setupOutput wraps stdout in an AsyncWriter if MODULE_METRICS_PASSTHROUGH_BUFFER_BYTES is set.
+// The AsyncWriter of a previous setup is reused, the readers it started may still be writing to it.
+func setupOutput(stdout io.Writer) (io.Writer, error) {
+	bufferBytesStr := os.Getenv("MODULE_METRICS_PASSTHROUGH_BUFFER_BYTES")
+	if bufferBytesStr == "" {
+		return stdout, nil
+	}
+
+	bufferBytes, err := strconv.Atoi(bufferBytesStr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "MODULE_METRICS_PASSTHROUGH_BUFFER_BYTES %s is invalid", bufferBytesStr)
+	}
+	policy := OverflowBlock
+	if policyName := os.Getenv("MODULE_METRICS_PASSTHROUGH_OVERFLOW"); policyName != "" {
+		policy, err = ParseOverflowPolicy(policyName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if outputWriter != nil {
+		outputWriter.reconfigure(stdout, bufferBytes, policy)
+		return outputWriter, nil
+	}
+	outputWriter = NewAsyncWriter(stdout, bufferBytes, policy)
+	return outputWriter, nil
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupInputs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+	defer func() { includeSourceLabel = false }()
+
+	accessPath := "/tmp/section.module.metrics-access"
+	errorPath := "/tmp/section.module.metrics-error"
+
+	var stdout bytes.Buffer
+	err := SetupInputs(&stdout, os.Stderr,
+		Input{Path: accessPath, Labels: []string{"status", "hostname"}},
+		Input{
+			Path:   errorPath,
+			Source: "error_log",
+			Labels: []string{"level"},
+			Parser: RegexParser(regexp.MustCompile(`^\S+ \S+ \[(?P<level>\w+)\]`)),
+		},
+	)
+	assert.NoError(t, err)
+
+	writeLogsTo(t, accessPath, []string{
+		`{"hostname":"www.example.com","status":"200","level":"ignored"}`,
+		`{"hostname":"www.example.com","status":"404"}`,
+	})
+	writeLogsTo(t, errorPath, []string{
+		`2019/06/20 01:34:36 [error] 7#7: *1 open() "/a/path" failed`,
+		`2019/06/20 01:34:37 [warn] 7#7: *2 upstream response is buffered`,
+		`not an error log line`,
+	})
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{level="",section_aee_healthcheck="false",source="section.module.metrics-access",status="200"} 1`)
+	assert.Contains(t, actual, `section_http_request_count_total{level="",section_aee_healthcheck="false",source="section.module.metrics-access",status="404"} 1`)
+	assert.Contains(t, actual, `section_http_request_count_total{level="error",section_aee_healthcheck="false",source="error_log",status=""} 1`)
+	assert.Contains(t, actual, `section_http_request_count_total{level="warn",section_aee_healthcheck="false",source="error_log",status=""} 1`)
+	assert.Contains(t, actual, `section_http_bytes_total{level="",source="section.module.metrics-access",status="200"} 0`)
+	assert.Contains(t, actual, `section_http_request_count_by_hostname_total{hostname="www.example.com"} 2`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="syntax"} 1`)
+
+	outputLines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, outputLines, 5)
+}
+
+func TestSetupInputsSingleInputHasNoSourceLabel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+
+	accessPath := "/tmp/section.module.metrics-single"
+
+	var stdout bytes.Buffer
+	err := SetupInputs(&stdout, os.Stderr, Input{Path: accessPath, Labels: []string{"status"}})
+	assert.NoError(t, err)
+
+	writeLogsTo(t, accessPath, []string{`{"status":"200"}`})
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="200"} 1`)
+}
+
+func TestSetupInputsTail(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+
+	dir := t.TempDir()
+	logPath := path.Join(dir, "access.log")
+	statePath := path.Join(dir, "access.state")
+	appendToFile(t, logPath, `{"status":"500"}`+"\n")
+
+	var stdout bytes.Buffer
+	err := SetupInputs(&stdout, os.Stderr,
+		Input{Kind: InputTail, Path: logPath, StateFile: statePath, Labels: []string{"status"}})
+	assert.NoError(t, err)
+
+	appendToFile(t, logPath, `{"status":"200"}`+"\n")
+	time.Sleep(2 * tailPollInterval)
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="200"} 1`)
+	assert.NotContains(t, actual, `status="500"`)
+	assert.Equal(t, `{"status":"200"}`+"\n", stdout.String())
+
+	readersMu.Lock()
+	r := readers[len(readers)-1]
+	readersMu.Unlock()
+	closeTailers()
+	assert.Eventually(t, func() bool { return r.state.Load() == readerStopped }, time.Second, 10*time.Millisecond)
+
+	info, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	state, err := os.ReadFile(statePath)
+	assert.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"inode":%d,"offset":%d}`, inodeOf(info), info.Size()), string(state))
+}
+
+func TestSetupInputsFails(t *testing.T) {
+	err := SetupInputs(os.Stdout, os.Stderr)
+	assert.Error(t, err)
+
+	err = SetupInputs(os.Stdout, os.Stderr,
+		Input{Path: "/tmp/a/access.log"},
+		Input{Path: "/tmp/b/access.log"},
+	)
+	assert.EqualError(t, err, "input source access.log is not unique")
+
+	err = SetupInputs(os.Stdout, os.Stderr, Input{Path: "/i/dont/exist/test-file"})
+	assert.Error(t, err)
+
+	// the inputs opened before the failing one are closed again
+	defer func() { includeSourceLabel = false }()
+	okPath := path.Join(t.TempDir(), "access.log")
+	err = SetupInputs(os.Stdout, os.Stderr, Input{Path: okPath}, Input{Path: "/i/dont/exist/test-file"})
+	assert.Error(t, err)
+	fifoWritersMu.Lock()
+	_, ok := fifoWriters[okPath]
+	fifoWritersMu.Unlock()
+	assert.False(t, ok)
+}
+
+func TestRegexParser(t *testing.T) {
+	parser := RegexParser(regexp.MustCompile(`^(?P<level>\w+): (?P<message>.*)$`))
+
+	logline, err := parser([]byte("error: upstream timed out"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"level": "error", "message": "upstream timed out"}, logline)
+
+	_, err = parser([]byte("no level"))
+	assert.Error(t, err)
+}
+
+func TestJSONParser(t *testing.T) {
+	logline, err := JSONParser([]byte(`{"status":"200","bytes":5}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"status": "200", "bytes": "5"}, logline)
+
+	_, err = JSONParser([]byte(`Not JSON`))
+	assert.Error(t, err)
+}
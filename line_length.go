@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxLineBytes = 1024 * 1024
+	minMaxLineBytes     = 16
+)
+
+// OversizedLinePolicy is what a reader does with a log line longer than the maximum line length.
+type OversizedLinePolicy int
+
+const (
+	// OversizedTruncate processes the start of the line, up to the maximum line length, as
+	// the line and discards the rest of it.
+	OversizedTruncate OversizedLinePolicy = iota
+	// OversizedForward writes the whole line to the output in pieces, without extracting
+	// any metrics from it or writing it to the sinks. The pieces aren't held back until the end
+	// of the line, so the lines of other inputs can be written between them. With redaction the
+	// line can't be redacted, so it is truncated instead.
+	OversizedForward
+)
+
+var oversizedLinePolicies = map[string]OversizedLinePolicy{
+	"truncate": OversizedTruncate,
+	"forward":  OversizedForward,
+}
+
+var (
+	maxLineBytes        = defaultMaxLineBytes
+	oversizedLinePolicy = OversizedTruncate
+)
+
+// ParseOversizedLinePolicy returns the OversizedLinePolicy named "truncate" or "forward".
+func ParseOversizedLinePolicy(name string) (OversizedLinePolicy, error) {
+	policy, ok := oversizedLinePolicies[name]
+	if !ok {
+		return OversizedTruncate, errors.Errorf("unknown oversized line policy %q", name)
+	}
+	return policy, nil
+}
+
+// SetMaxLineLength sets the maximum length of a log line, including the newline, and what
+// to do with longer lines. Readers started afterwards never buffer more than maxBytes of a line.
+func SetMaxLineLength(maxBytes int, policy OversizedLinePolicy) {
+	if maxBytes < minMaxLineBytes {
+		maxBytes = minMaxLineBytes
+	}
+	maxLineBytes = maxBytes
+	oversizedLinePolicy = policy
+}
+
+// setupMaxLineLength applies MODULE_METRICS_MAX_LINE_BYTES and MODULE_METRICS_OVERSIZED_LINES.
+func setupMaxLineLength() error {
+	maxBytes := maxLineBytes
+	if maxBytesStr := os.Getenv("MODULE_METRICS_MAX_LINE_BYTES"); maxBytesStr != "" {
+		var err error
+		maxBytes, err = strconv.Atoi(maxBytesStr)
+		if err != nil {
+			return errors.Wrapf(err, "MODULE_METRICS_MAX_LINE_BYTES %s is invalid", maxBytesStr)
+		}
+	}
+
+	policy := oversizedLinePolicy
+	if policyName := os.Getenv("MODULE_METRICS_OVERSIZED_LINES"); policyName != "" {
+		var err error
+		policy, err = ParseOversizedLinePolicy(policyName)
+		if err != nil {
+			return err
+		}
+	}
+
+	SetMaxLineLength(maxBytes, policy)
+	return nil
+}
+
+// readLines processes the lines read from lineReader until reading fails, returning the error
+// and whether anything was read. The start of an unfinished line is kept in r.partial.
+func (r *reader) readLines(lineReader *bufio.Reader, committer lineCommitter) (bool, error) {
+	readAny := false
+	for {
+		chunk, err := lineReader.ReadSlice('\n')
+		if len(chunk) > 0 {
+			readAny = true
+		}
+		complete := err == nil
+
+		switch {
+		case r.oversizedBytes > 0:
+			r.continueOversized(chunk, complete, committer)
+		case err == bufio.ErrBufferFull || len(r.partial)+len(chunk) > r.maxLineBytes:
+			r.startOversized(chunk, complete, committer)
+		case complete:
+			line := append(r.partial, chunk...)
+			r.partial = nil
+			r.lineRead(len(line))
+			r.dispatch(line, false, commitLater(committer, len(line)))
+		default:
+			// Keep the start of a line the writer hadn't finished, it continues after the reopen
+			r.partial = append(r.partial, chunk...)
+		}
+
+		if err != nil && err != bufio.ErrBufferFull {
+			return readAny, err
+		}
+	}
+}
+
+func (r *reader) startOversized(chunk []byte, complete bool, committer lineCommitter) {
+	oversizedLinesTotal.WithLabelValues(r.source).Inc()
+
+	line := append(r.partial, chunk...)
+	r.partial = nil
+	r.oversizedBytes = len(line)
+	r.forwarding = forwardingOversized()
+
+	switch {
+	case r.forwarding:
+		// the lines before it have to be written first
+		r.drain()
+		r.forward(line)
+	default:
+		truncated := make([]byte, r.maxLineBytes)
+		copy(truncated, line[:r.maxLineBytes-1])
+		truncated[r.maxLineBytes-1] = '\n'
+		r.dispatch(truncated, true, nil)
+	}
+
+	if complete {
+		r.endOversized(committer)
+	}
+}
+
+func (r *reader) continueOversized(chunk []byte, complete bool, committer lineCommitter) {
+	r.oversizedBytes += len(chunk)
+	if r.forwarding {
+		r.forward(chunk)
+	}
+	if complete {
+		r.endOversized(committer)
+	}
+}
+
+func (r *reader) endOversized(committer lineCommitter) {
+	r.lineRead(r.oversizedBytes)
+	if r.forwarding {
+		passthroughLinesTotal.WithLabelValues(passthroughForwarded).Inc()
+	}
+	if committer != nil {
+		// the truncated line has to be processed first
+		r.drain()
+		committer.commitLater(r.oversizedBytes)()
+	}
+	r.oversizedBytes = 0
+}
+
+// forwardingOversized reports whether oversized lines are forwarded, redaction needs the
+// whole line so they are truncated when it is enabled.
+func forwardingOversized() bool {
+	return oversizedLinePolicy == OversizedForward && redaction == nil
+}
+
+// forward writes a piece of an oversized line to the output. The output isn't held until the
+// end of the line as the rest of it may take any time to arrive, so with several inputs the
+// lines of the others can be written between the pieces.
+func (r *reader) forward(piece []byte) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := r.output.Write(piece)
+	if err != nil {
+		panic(errors.Wrapf(err, "Writing to output failed"))
+	}
+}
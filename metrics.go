@@ -2,14 +2,16 @@ package metrics //import github.com/section-io/module-metrics
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -20,6 +22,8 @@ const (
 	geoLatLon               = "latlon"
 	geoMissing              = "missing"
 	geoDefaultHashPrecision = uint(2)
+	fifoReopenMinBackoff    = 10 * time.Millisecond
+	fifoReopenMaxBackoff    = 5 * time.Second
 )
 
 var (
@@ -27,6 +31,13 @@ var (
 	isValidHostHeader      = regexp.MustCompile(`^[a-z0-9.-]+$`).MatchString
 	isGeoHashing           = false
 	effectiveHashPrecision = geoDefaultHashPrecision
+
+	// the writer kept open per fifo path, see OpenWriteFifo
+	fifoWritersMu sync.Mutex
+	fifoWriters   = map[string]*os.File{}
+
+	outputMu sync.Mutex
+	errorMu  sync.Mutex
 )
 
 func sanitizeLabelName(label string) string {
@@ -38,15 +49,24 @@ func sanitizeLabelName(label string) string {
 	}
 }
 
-func sanitizeLabelValue(label string, value interface{}) string {
+func sanitizeLabelValue(label string, value string) string {
+	labelValue, _ := sanitizeLabelValueFallback(label, value)
+	return labelValue
+}
 
-	if value == nil || value == "" || value == "-" {
-		return ""
+// sanitizeLabelValueFallback sanitizes the label value, also reporting whether the value was
+// replaced by a fallback or truncated.
+func sanitizeLabelValueFallback(label string, value string) (string, bool) {
+
+	if value == "" || value == "-" {
+		return "", false
 	}
 
-	// Convert to a string, no matter what underlying type it is
-	labelValue := fmt.Sprintf("%v", value)
-	labelValue = strings.TrimSpace(labelValue)
+	labelValue := strings.TrimSpace(value)
+	if labelValue == "" {
+		return "", false
+	}
+	fallback := false
 
 	switch label {
 	case "content_type":
@@ -61,6 +81,7 @@ func sanitizeLabelValue(label string, value interface{}) string {
 			labelValue = "javascript"
 		} else {
 			labelValue = "other"
+			fallback = true
 		}
 
 	case "hostname":
@@ -68,6 +89,7 @@ func sanitizeLabelValue(label string, value interface{}) string {
 		labelValue = strings.ToLower(labelValue)
 		if !isValidHostHeader(labelValue) {
 			labelValue = ""
+			fallback = true
 		}
 
 	case "status":
@@ -83,40 +105,47 @@ func sanitizeLabelValue(label string, value interface{}) string {
 			// If it matches any of the above cases, do nothing (leave labelValue as is)
 			// otherwise set to blank
 			labelValue = ""
+			fallback = true
 		}
 	}
 
 	if len(labelValue) > maxLabelValueLength {
 		labelValue = labelValue[0:maxLabelValueLength]
+		fallback = true
 	}
 
-	return labelValue
+	return labelValue, fallback
 }
 
-func getBytes(l map[string]interface{}) int {
+func getBytes(l map[string]string) int {
 
-	var bytes interface{}
-	var ok bool
-
-	if bytes, ok = l["bytes"]; !ok {
-		bytes = l["bytes_sent"]
+	value, ok := l["bytes"]
+	if !ok {
+		value = l["bytes_sent"]
 	}
 
-	// Force convert to a string then to int, simpler than trying to figure out what the
-	// underlying type is. Atoi will return a 0 if the string can't be converted to an int.
-	bytes, _ = strconv.Atoi(fmt.Sprintf("%v", bytes))
+	// Atoi will return a 0 if the string can't be converted to an int, numbers in the JSON
+	// such as 1.5e3 are kept as they were written so fall back to parsing a float.
+	bytes, err := strconv.Atoi(value)
+	if err != nil {
+		floatBytes, _ := strconv.ParseFloat(value, 64)
+		bytes = int(floatBytes)
+	}
 
 	// Do not fail if bytes_sent < 0, for e.g. 499 status code
-	if bytes.(int) < 0 {
+	if bytes < 0 {
 		bytes = 0
 	}
 
-	return bytes.(int)
+	return bytes
 }
 
 // CreateLogFifo creates the log pipe, will remove the file first if it already exists.
 func CreateLogFifo(path string) error {
 
+	// a reader still on the old fifo gets EOF and reopens the new one
+	closeWriteFifo(path)
+
 	err := os.Remove(path)
 	if err != nil && !os.IsNotExist(err) {
 		return errors.Wrapf(err, "Remove %s failed: %v", path, err)
@@ -141,14 +170,34 @@ func CreateLogFifo(path string) error {
 // OpenWriteFifo opens the fifo file for reading, returning the reader
 func OpenWriteFifo(path string) error {
 	// Open temp writer
-	_, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+	writer, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
 	if err != nil {
 		return errors.Wrapf(err, "OpenWriteFifo %s failed: %v", path, err)
 	}
 
+	// Keep the writer open so the reader doesn't get an EOF, and have to reopen the fifo,
+	// whenever no other program has it open. Left to the garbage collector it would be
+	// closed at a random time.
+	closeWriteFifo(path)
+	fifoWritersMu.Lock()
+	fifoWriters[path] = writer
+	fifoWritersMu.Unlock()
+
 	return nil
 }
 
+// closeWriteFifo closes the writer OpenWriteFifo kept open for the path, if any.
+func closeWriteFifo(path string) {
+	fifoWritersMu.Lock()
+	writer := fifoWriters[path]
+	delete(fifoWriters, path)
+	fifoWritersMu.Unlock()
+
+	if writer != nil {
+		_ = writer.Close()
+	}
+}
+
 // OpenReadFifo opens the fifo file for reading, returning the reader
 func OpenReadFifo(path string) (io.ReadCloser, error) {
 	file, err := os.OpenFile(
@@ -161,73 +210,259 @@ func OpenReadFifo(path string) (io.ReadCloser, error) {
 	return file, nil
 }
 
-// StartReader starts a loop in a goroutine that reads from the fifo file and writes out to the
-// output file. Any errors regarding parsing the log line are written to the errorWriter (eg os.Stderr)
-// but do not panic.
-func StartReader(file io.ReadCloser, output io.Writer, errorWriter io.Writer) {
+// reopenReadFifo opens the fifo file for reading, blocking until a writer opens it.
+func reopenReadFifo(path string) (io.ReadCloser, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, os.ModeNamedPipe)
+	if err != nil {
+		return nil, errors.Wrapf(err, "OpenReadFifo %s failed: %v", path, err)
+	}
+	return file, nil
+}
 
-	go func() {
+// reader processes the log lines of a single input.
+type reader struct {
+	source      string
+	path        string
+	reopen      func(path string) (io.ReadCloser, error)
+	labels      map[string]struct{}
+	parser      Parser
+	output      io.Writer
+	errorWriter io.Writer
+
+	// state of the read loop
+	maxLineBytes   int
+	partial        []byte
+	oversizedBytes int
+	// whether the oversized line being read is forwarded, the policy when it started
+	forwarding bool
+
+	// lines dispatched to the workers, see dispatch
+	dispatching bool
+	pool        *workerPool
+	results     chan *lineJob
+	inFlight    sync.WaitGroup
+
+	// checked by /readyz
+	state    atomic.Int32
+	started  time.Time
+	lastLine atomic.Int64
+}
 
-		reader := bufio.NewReader(file)
-		line, err := reader.ReadBytes('\n')
-		for err == nil {
+// usesLabel reports whether the label is taken from this input's log lines, a reader without
+// its own labels uses all of them.
+func (r *reader) usesLabel(label string) bool {
+	if r.labels == nil {
+		return true
+	}
+	_, ok := r.labels[label]
+	return ok
+}
 
-			_, writeErr := output.Write(line)
-			if writeErr != nil {
-				panic(errors.Wrapf(writeErr, "Writing to output failed"))
-			}
+// processLine extracts the metrics from a single log line and then writes it to the output,
+// redacted and enriched with the derived fields if configured.
+func (r *reader) processLine(line []byte) {
+	if output, fields, write := r.process(line, false, 0); write {
+		r.write(output, fields)
+	}
+}
 
-			var logline map[string]interface{}
-			jsonErr := json.Unmarshal(line, &logline)
-			if jsonErr != nil {
-				_, _ = fmt.Fprintf(errorWriter, "json.Unmarshal failed: %v", jsonErr)
-				jsonParseErrorTotal.Inc()
-			} else {
-				labelValues := map[string]string{}
-
-				for _, label := range logFieldNames {
-					value := sanitizeLabelValue(label, logline[label])
-					label = sanitizeLabelName(label)
-					labelValues[label] = value
-				}
-				if isGeoHashing {
-					labelsWithGeoHash, coord := convertLatLonToHash(labelValues, logline)
-					labelValues = labelsWithGeoHash
-					if !coord.isValid() {
-						coord.logErrors(logline, func(f string, args ...interface{}) {
-							_, err := fmt.Fprintf(errorWriter, f, args...)
-							if err != nil {
-								panic(errors.Wrapf(err,
-									"Couldn't write to provided error writer"))
-							}
-						})
-					}
-				}
-				isAeeHealthcheck := aeeUserAgentRegex.MatchString(extractUserAgent(logline))
-				labelValues[aeeHealthcheckLabel] = strconv.FormatBool(isAeeHealthcheck)
-				addRequest(labelValues, logline)
-			}
+// process extracts the metrics from a single log line into the worker's shard of the counters,
+// returning the line to write to the output if it's sampled in. A truncated line is the start
+// of an oversized one.
+func (r *reader) process(line []byte, truncated bool, worker int) ([]byte, map[string]string, bool) {
+	start := time.Now()
+	defer func() {
+		lineProcessingSeconds.WithLabelValues(r.source).Observe(time.Since(start).Seconds())
+	}()
 
-			line, err = reader.ReadBytes('\n')
+	logline, parseErr := r.parser(line)
+	if parseErr != nil {
+		r.reportParseError(line, parseErr, truncated)
+		if redaction != nil {
+			// a line that can't be parsed can't be redacted, so it's left out of the output
+			passthroughLinesTotal.WithLabelValues(passthroughUnredactable).Inc()
+			return nil, nil, false
 		}
+		return line, nil, isSampledIn(nil)
+	}
 
-		// If EOF is reached the writer program closed the file, so reopen it
-		if err == io.EOF {
-			err := file.Close()
+	labelValues := map[string]string{}
 
-			if err != nil {
-				panic(err)
-			}
-			file, err = OpenReadFifo(filepath)
-			if err != nil {
-				panic(err)
+	for _, label := range logFieldNames {
+		value := ""
+		if r.usesLabel(label) {
+			var fallback bool
+			value, fallback = sanitizeLabelValueFallback(label, logline[label])
+			if fallback {
+				labelSanitizationFallbacksTotal.WithLabelValues(label).Inc()
 			}
-			StartReader(file, output, errorWriter)
+		}
+		label = sanitizeLabelName(label)
+		labelValues[label] = value
+	}
+	if includeSourceLabel {
+		labelValues[sourceLabel] = r.source
+	}
+	if isGeoHashing {
+		labelsWithGeoHash, coord := convertLatLonToHash(labelValues, logline)
+		labelValues = labelsWithGeoHash
+		if !coord.isValid() {
+			coord.logErrors(logline, func(f string, args ...interface{}) {
+				errorMu.Lock()
+				defer errorMu.Unlock()
+				_, err := fmt.Fprintf(r.errorWriter, f, args...)
+				if err != nil {
+					panic(errors.Wrapf(err,
+						"Couldn't write to provided error writer"))
+				}
+			})
+		}
+	}
+	isAeeHealthcheck := aeeUserAgentRegex.MatchString(extractUserAgent(logline))
+	labelValues[aeeHealthcheckLabel] = strconv.FormatBool(isAeeHealthcheck)
+
+	// derive before addRequest, which removes the hostname from labelValues
+	var fields map[string]string
+	if isEnrichingLogs || len(sampleRules) > 0 || len(sinks) > 0 {
+		fields = deriveFields(labelValues, logline)
+	}
+
+	addRequestToShard(labelValues, logline, worker)
+
+	if !isSampledIn(fields) {
+		return nil, nil, false
+	}
+
+	if redaction != nil {
+		line = redaction.redactLine(line)
+	}
+	if isEnrichingLogs {
+		line = appendFields(line, fields, logline)
+	}
+
+	return line, fields, true
+}
+
+// lineRead counts a line of n bytes read from the input.
+func (r *reader) lineRead(n int) {
+	now := time.Now().UnixNano()
+	r.lastLine.Store(now)
+	linesReadTotal.WithLabelValues(r.source).Inc()
+	bytesReadTotal.WithLabelValues(r.source).Add(float64(n))
+	lastLineTimestampSeconds.WithLabelValues(r.source).Set(float64(now) / 1e9)
+}
+
+// errorf writes to the error writer, serialised as the workers of all the readers share it.
+func (r *reader) errorf(format string, args ...interface{}) {
+	errorMu.Lock()
+	defer errorMu.Unlock()
+	_, _ = fmt.Fprintf(r.errorWriter, format, args...)
+}
+
+// write writes the line to the output and the sinks, serialised across the readers of all
+// the inputs as the writers don't need to be safe for concurrent use.
+func (r *reader) write(line []byte, fields map[string]string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	writeOutput(r.output, line)
+	writeSinks(line, fields)
+}
+
+func writeOutput(output io.Writer, line []byte) {
+	_, err := output.Write(line)
+	if err != nil {
+		panic(errors.Wrapf(err, "Writing to output failed"))
+	}
+	passthroughLinesTotal.WithLabelValues(passthroughForwarded).Inc()
+}
+
+// lineCommitter is implemented by inputs that track which of the lines read from them
+// have been processed. commitLater returns the function to call once the line of n bytes
+// just read has been processed.
+type lineCommitter interface {
+	commitLater(n int) func()
+}
+
+func commitLater(committer lineCommitter, n int) func() {
+	if committer == nil {
+		return nil
+	}
+	return committer.commitLater(n)
+}
+
+// start starts a loop in a goroutine that reads from the file, reopening it at the reader's
+// path when the writer closes it. A reader without reopen stops at EOF.
+func (r *reader) start(file io.ReadCloser) {
+	trackReader(r)
+	r.state.Store(readerOpen)
+	go r.run(file)
+}
+
+func (r *reader) run(file io.ReadCloser) {
+	defer r.state.Store(readerStopped)
+	r.maxLineBytes = maxLineBytes
+	lineReader := bufio.NewReaderSize(file, r.maxLineBytes)
+	backoff := fifoReopenMinBackoff
+
+	for {
+		committer, _ := file.(lineCommitter)
+		readAny, err := r.readLines(lineReader, committer)
+		if err != io.EOF {
+			_, _ = fmt.Fprintf(r.errorWriter, "Reading %s failed: %v\n", r.path, err)
+		}
+		if closeErr := file.Close(); closeErr != nil {
+			_, _ = fmt.Fprintf(r.errorWriter, "Closing %s failed: %v\n", r.path, closeErr)
+		}
+		if r.reopen == nil {
+			r.stopDispatching()
 			return
 		}
 
-		panic(errors.Wrapf(err, "ReadBytes failed"))
-	}()
+		// If EOF is reached the writer program closed the file, so reopen it. Back off when
+		// the file keeps failing without delivering anything so it can't spin.
+		r.state.Store(readerReopening)
+		if readAny {
+			backoff = fifoReopenMinBackoff
+		} else {
+			backoff = sleepBackoff(backoff)
+		}
+		for {
+			file, err = r.reopen(r.path)
+			if err == nil {
+				break
+			}
+			_, _ = fmt.Fprintf(r.errorWriter, "%v\n", err)
+			backoff = sleepBackoff(backoff)
+		}
+		r.state.Store(readerOpen)
+		fifoReopensTotal.WithLabelValues(r.source).Inc()
+		lineReader.Reset(file)
+	}
+}
+
+// sleepBackoff waits for the backoff, returning the next one.
+func sleepBackoff(backoff time.Duration) time.Duration {
+	time.Sleep(backoff)
+	backoff *= 2
+	if backoff > fifoReopenMaxBackoff {
+		backoff = fifoReopenMaxBackoff
+	}
+	return backoff
+}
+
+// StartReader starts a loop in a goroutine that reads from the fifo file and writes out to the
+// output file. Any errors regarding parsing the log line are written to the errorWriter (eg os.Stderr)
+// but do not panic.
+func StartReader(file io.ReadCloser, output io.Writer, errorWriter io.Writer) {
+	r := &reader{
+		source:      defaultSource,
+		path:        filepath,
+		reopen:      reopenReadFifo,
+		parser:      JSONParser,
+		output:      output,
+		errorWriter: errorWriter,
+	}
+	r.start(file)
 }
 
 // SetupWithGeoHash looks to extract lat/lon from logs and produce a
@@ -240,6 +475,7 @@ func SetupWithGeoHash(
 	additionalLabels ...string) error {
 
 	isGeoHashing = true
+	adaptiveGeo = nil
 	if precision < 1 || precision > 12 {
 		effectiveHashPrecision = geoDefaultHashPrecision
 	} else {
@@ -248,27 +484,24 @@ func SetupWithGeoHash(
 	return SetupModule(path, stdout, stderr, additionalLabels...)
 }
 
+// SetupWithAdaptiveGeoHash is like SetupWithGeoHash but rather than a single
+// precision it starts every coordinate at config.MinPrecision and subdivides
+// cells that exceed config.SplitThreshold requests, up to config.MaxPrecision,
+// while keeping the number of distinct 'geo_hash' labels within config.MaxCells.
+func SetupWithAdaptiveGeoHash(
+	path string,
+	stdout io.Writer, stderr io.Writer,
+	config AdaptiveGeoHashConfig,
+	additionalLabels ...string) error {
+
+	isGeoHashing = true
+	adaptiveGeo = newAdaptiveGeoHasher(config)
+	effectiveHashPrecision = adaptiveGeo.config.MinPrecision
+	return SetupModule(path, stdout, stderr, additionalLabels...)
+}
+
 // SetupModule does the default setup scenario: creating & opening the FIFO file,
 // starting the Prometheus server and starting the reader.
 func SetupModule(path string, stdout io.Writer, stderr io.Writer, additionalLabels ...string) error {
-	err := CreateLogFifo(path)
-	if err != nil {
-		return err
-	}
-
-	reader, err := OpenReadFifo(path)
-	if err != nil {
-		return err
-	}
-
-	err = OpenWriteFifo(path)
-	if err != nil {
-		return err
-	}
-
-	InitMetrics(additionalLabels...)
-
-	StartReader(reader, stdout, stderr)
-
-	return nil
+	return SetupInputs(stdout, stderr, Input{Path: path, Labels: additionalLabels})
 }
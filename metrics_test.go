@@ -1,8 +1,13 @@
 package metrics
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,6 +27,32 @@ func TestCreateLogFifo(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestOpenWriteFifo(t *testing.T) {
+	path := "/tmp/TestOpenWriteFifo-file"
+	defer os.Remove(path)
+	assert.NoError(t, CreateLogFifo(path))
+	file, err := OpenReadFifo(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	assert.NoError(t, OpenWriteFifo(path))
+	first := fifoWriters[path]
+	assert.NoError(t, OpenWriteFifo(path))
+	second := fifoWriters[path]
+	assert.NotSame(t, first, second)
+	// the writer is replaced rather than kept forever
+	_, err = first.Write([]byte("x"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	// setting the fifo up again closes its writer, so the old reader gets EOF
+	assert.NoError(t, CreateLogFifo(path))
+	assert.NotContains(t, fifoWriters, path)
+	_, err = second.Write([]byte("x"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+	_, err = io.ReadAll(file)
+	assert.NoError(t, err)
+}
+
 func TestCreateLogFifoFails(t *testing.T) {
 	nonExistantPath := "/i/dont/exist/test-file"
 
@@ -102,7 +133,7 @@ func TestUnsanitizedLabel(t *testing.T) {
 
 func TestSanitizeNil(t *testing.T) {
 	const expected = ""
-	actual := sanitizeLabelValue("foo", nil)
+	actual := sanitizeLabelValue("foo", "")
 
 	assert.Equal(t, expected, actual)
 }
@@ -131,7 +162,7 @@ func TestSanitizeHostnameWithSpaces(t *testing.T) {
 func TestSanitizeHostnameMissing(t *testing.T) {
 	const expected = ""
 
-	actual := sanitizeLabelValue("hostname", nil)
+	actual := sanitizeLabelValue("hostname", "")
 	assert.Equal(t, expected, actual)
 
 	actual = sanitizeLabelValue("hostname", "-")
@@ -188,49 +219,228 @@ func TestSanitizeMaxLength(t *testing.T) {
 
 func TestGetBytes(t *testing.T) {
 	const expected = 5
-	actual := getBytes(map[string]interface{}{"bytes": "5"})
+	actual := getBytes(parseLogLine(map[string]interface{}{"bytes": "5"}))
 
 	assert.Equal(t, expected, actual)
 }
 
 func TestGetBytesSent(t *testing.T) {
 	const expected = 5
-	actual := getBytes(map[string]interface{}{"bytes_sent": "5"})
+	actual := getBytes(parseLogLine(map[string]interface{}{"bytes_sent": "5"}))
 
 	assert.Equal(t, expected, actual)
 }
 
 func TestNegativeBytesSent(t *testing.T) {
 	const expected = 0
-	actual := getBytes(map[string]interface{}{"bytes_sent": "-1"})
+	actual := getBytes(parseLogLine(map[string]interface{}{"bytes_sent": "-1"}))
 
 	assert.Equal(t, expected, actual)
 }
 
 func TestGetBytesInt(t *testing.T) {
 	const expected = 5
-	actual := getBytes(map[string]interface{}{"bytes": 5})
+	actual := getBytes(parseLogLine(map[string]interface{}{"bytes": 5}))
 
 	assert.Equal(t, expected, actual)
 }
 
 func TestGetBytesSentInt(t *testing.T) {
 	const expected = 5
-	actual := getBytes(map[string]interface{}{"bytes_sent": 5})
+	actual := getBytes(parseLogLine(map[string]interface{}{"bytes_sent": 5}))
 
 	assert.Equal(t, expected, actual)
 }
 
 func TestGetBytesDash(t *testing.T) {
 	const expected = 0
-	actual := getBytes(map[string]interface{}{"bytes": "-"})
+	actual := getBytes(parseLogLine(map[string]interface{}{"bytes": "-"}))
 
 	assert.Equal(t, expected, actual)
 }
 
 func TestGetBytesMissing(t *testing.T) {
 	const expected = 0
-	actual := getBytes(map[string]interface{}{"somthing": "foo"})
+	actual := getBytes(parseLogLine(map[string]interface{}{"somthing": "foo"}))
 
 	assert.Equal(t, expected, actual)
 }
+
+func TestReaderReopensAndKeepsPartialLines(t *testing.T) {
+	InitMetrics("status")
+
+	// the writer closes the file in the middle of a line and then twice without writing
+	parts := []string{`{"status":"2`, ``, ``, `00"}` + "\n" + `{"status":"404"}` + "\n"}
+	opened := make(chan struct{})
+	reopen := func(path string) (io.ReadCloser, error) {
+		if len(parts) == 0 {
+			close(opened)
+			blocked, _ := io.Pipe()
+			return blocked, nil
+		}
+		part := parts[0]
+		parts = parts[1:]
+		return io.NopCloser(strings.NewReader(part)), nil
+	}
+
+	var stdout bytes.Buffer
+	r := &reader{source: "test", path: "/tmp/TestReader", reopen: reopen, parser: JSONParser, output: &stdout, errorWriter: os.Stderr}
+	first, _ := reopen(r.path)
+	r.start(first)
+
+	select {
+	case <-opened:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the reader to reopen")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, `{"status":"200"}`+"\n"+`{"status":"404"}`+"\n", stdout.String())
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="200"} 1`)
+	assert.Contains(t, actual, `section_http_fifo_reopens_total{source="test"} 4`)
+	assert.Empty(t, parts)
+}
+
+func TestReaderOversizedLines(t *testing.T) {
+	defer SetMaxLineLength(defaultMaxLineBytes, OversizedTruncate)
+
+	long := `{"status":"200","request":"GET /` + strings.Repeat("a", 100) + `"}`
+	logs := `{"status":"404"}` + "\n" + long + "\n" + `{"status":"500"}` + "\n"
+
+	tcs := []struct {
+		policy OversizedLinePolicy
+		output string
+		errors string
+	}{
+		{OversizedTruncate, `{"status":"404"}` + "\n" + long[:31] + "\n" + `{"status":"500"}` + "\n", "1"},
+		{OversizedForward, logs, "0"},
+	}
+
+	for _, tc := range tcs {
+		InitMetrics("status")
+		SetMaxLineLength(32, tc.policy)
+
+		var stdout bytes.Buffer
+		r := &reader{source: "test", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+		r.run(io.NopCloser(strings.NewReader(logs)))
+
+		assert.Equal(t, tc.output, stdout.String())
+		actual := gatherP8sResponse(t)
+		assert.Contains(t, actual, `section_http_oversized_lines_total{source="test"} 1`)
+		assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="oversized"} `+tc.errors)
+		assert.Contains(t, actual, `section_http_passthrough_lines_total{result="forwarded"} 3`)
+		assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="500"} 1`)
+	}
+}
+
+func TestReaderForwardDoesNotHoldOutput(t *testing.T) {
+	defer SetMaxLineLength(defaultMaxLineBytes, OversizedTruncate)
+	InitMetrics()
+	SetMaxLineLength(16, OversizedForward)
+
+	var stdout bytes.Buffer
+	pipeReader, pipeWriter := io.Pipe()
+	forwarding := &reader{source: "forwarding", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+	forwarded := make(chan struct{})
+	go func() {
+		forwarding.run(pipeReader)
+		close(forwarded)
+	}()
+	_, err := pipeWriter.Write([]byte(strings.Repeat("a", 40)))
+	assert.NoError(t, err)
+
+	written := make(chan struct{})
+	go func() {
+		other := &reader{source: "other", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+		other.processLine([]byte(`{"status":"200"}` + "\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the output held by the unfinished oversized line")
+	}
+
+	assert.NoError(t, pipeWriter.Close())
+	<-forwarded
+}
+
+func TestReaderOversizedPolicyChangedMidLine(t *testing.T) {
+	defer SetMaxLineLength(defaultMaxLineBytes, OversizedTruncate)
+	InitMetrics()
+	SetMaxLineLength(16, OversizedTruncate)
+
+	var stdout bytes.Buffer
+	pipeReader, pipeWriter := io.Pipe()
+	r := &reader{source: "test", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+	done := make(chan struct{})
+	go func() {
+		r.run(pipeReader)
+		close(done)
+	}()
+
+	_, err := pipeWriter.Write([]byte(strings.Repeat("a", 20)))
+	assert.NoError(t, err)
+	// the line started out truncated, the rest of it isn't forwarded
+	SetMaxLineLength(16, OversizedForward)
+	_, err = pipeWriter.Write([]byte(strings.Repeat("b", 20) + "\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, pipeWriter.Close())
+	<-done
+
+	assert.Equal(t, strings.Repeat("a", 15)+"\n", stdout.String())
+}
+
+func TestReaderOversizedLinesRedacted(t *testing.T) {
+	defer SetMaxLineLength(defaultMaxLineBytes, OversizedTruncate)
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{{Field: "remote_addr", Action: RedactTruncateIP}}})
+	defer SetRedaction(RedactionConfig{})
+
+	long := `{"remote_addr":"198.51.100.23","request":"GET /` + strings.Repeat("a", 100) + `"}`
+	logs := `{"remote_addr":"198.51.100.23"}` + "\n" + long + "\n"
+
+	for _, policy := range []OversizedLinePolicy{OversizedTruncate, OversizedForward} {
+		InitMetrics()
+		SetMaxLineLength(48, policy)
+
+		var stdout bytes.Buffer
+		r := &reader{source: "test", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+		r.run(io.NopCloser(strings.NewReader(logs)))
+
+		assert.Equal(t, `{"remote_addr":"198.51.100.0"}`+"\n", stdout.String())
+		assert.NotContains(t, stdout.String(), "198.51.100.23")
+		actual := gatherP8sResponse(t)
+		assert.Contains(t, actual, `section_http_oversized_lines_total{source="test"} 1`)
+		assert.Contains(t, actual, `section_http_passthrough_lines_total{result="unredactable"} 1`)
+	}
+}
+
+func TestParseOversizedLinePolicy(t *testing.T) {
+	policy, err := ParseOversizedLinePolicy("forward")
+	assert.NoError(t, err)
+	assert.Equal(t, OversizedForward, policy)
+
+	_, err = ParseOversizedLinePolicy("drop")
+	assert.Error(t, err)
+}
+
+func TestReaderPipelineMetrics(t *testing.T) {
+	InitMetrics("status", "hostname")
+
+	logs := `{"status":"200","hostname":"www.example.com"}` + "\n" +
+		`{"status":"999","hostname":"www.fi$h.com"}` + "\n" +
+		`not json` + "\n"
+
+	r := &reader{source: "test", parser: JSONParser, output: io.Discard, errorWriter: io.Discard}
+	r.run(io.NopCloser(strings.NewReader(logs)))
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_lines_read_total{source="test"} 3`)
+	assert.Contains(t, actual, fmt.Sprintf(`section_http_bytes_read_total{source="test"} %d`, len(logs)))
+	assert.Contains(t, actual, `section_http_line_processing_seconds_count{source="test"} 3`)
+	assert.Contains(t, actual, `section_http_last_line_timestamp_seconds{source="test"} `)
+	assert.Contains(t, actual, `section_http_label_sanitization_fallbacks_total{label="status"} 1`)
+	assert.Contains(t, actual, `section_http_label_sanitization_fallbacks_total{label="hostname"} 1`)
+	assert.Contains(t, actual, `go_build_info{`)
+}
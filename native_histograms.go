@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultNativeHistogramBucketFactor = 1.1
+	nativeHistogramMaxBucketNumber     = 160
+	nativeHistogramMinResetDuration    = time.Hour
+)
+
+var (
+	// the growth factor between the buckets of the native histograms, 0 when they are disabled
+	nativeHistogramBucketFactor float64
+)
+
+// setupNativeHistograms applies MODULE_METRICS_NATIVE_HISTOGRAMS and
+// MODULE_METRICS_NATIVE_HISTOGRAM_BUCKET_FACTOR.
+func setupNativeHistograms() {
+	nativeHistogramBucketFactor = 0
+	if !envBool("MODULE_METRICS_NATIVE_HISTOGRAMS") {
+		return
+	}
+
+	nativeHistogramBucketFactor = defaultNativeHistogramBucketFactor
+	if factorStr := os.Getenv("MODULE_METRICS_NATIVE_HISTOGRAM_BUCKET_FACTOR"); factorStr != "" {
+		factor, err := strconv.ParseFloat(factorStr, 64)
+		if err != nil || factor <= 1 {
+			log.Printf("[WARN] MODULE_METRICS_NATIVE_HISTOGRAM_BUCKET_FACTOR %s is not a number greater than 1, using %g\n", factorStr, nativeHistogramBucketFactor)
+			return
+		}
+		nativeHistogramBucketFactor = factor
+	}
+}
+
+// withNativeHistogram returns the opts of a request histogram, also emitting a native histogram
+// besides the classic buckets when they are enabled.
+func withNativeHistogram(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if nativeHistogramBucketFactor > 1 {
+		opts.NativeHistogramBucketFactor = nativeHistogramBucketFactor
+		opts.NativeHistogramMaxBucketNumber = nativeHistogramMaxBucketNumber
+		opts.NativeHistogramMinResetDuration = nativeHistogramMinResetDuration
+	}
+	return opts
+}
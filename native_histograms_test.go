@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"io"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatherHistogram returns the histogram of the family with the name.
+func gatherHistogram(t *testing.T, name string) *dto.Histogram {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name && len(family.GetMetric()) > 0 {
+			return family.GetMetric()[0].GetHistogram()
+		}
+	}
+	t.Fatalf("%s not gathered", name)
+	return nil
+}
+
+func TestNativeHistograms(t *testing.T) {
+	defer func() { serverDisabled = false }()
+	DisableServer()
+
+	line := []byte(`{"status":200,"bytes":2048,"request_time":"0.042"}` + "\n")
+
+	// the histograms are opt-in
+	InitMetrics()
+	r := &reader{source: defaultSource, parser: JSONParser, output: io.Discard, errorWriter: io.Discard}
+	r.processLine(line)
+	actual := gatherP8sResponse(t)
+	assert.NotContains(t, actual, "section_http_request_duration_seconds")
+	assert.NotContains(t, actual, "section_http_response_size_bytes")
+	config, err := currentDebugConfig()
+	assert.NoError(t, err)
+	assert.False(t, config.RequestHistograms)
+
+	t.Setenv("MODULE_METRICS_REQUEST_HISTOGRAMS", "true")
+	InitMetrics()
+	r.processLine(line)
+	duration := gatherHistogram(t, "section_http_request_duration_seconds")
+	assert.Equal(t, uint64(1), duration.GetSampleCount())
+	assert.Empty(t, duration.GetPositiveSpan())
+	assert.Equal(t, 0.0, currentDebugConfigBucketFactor(t))
+
+	t.Setenv("MODULE_METRICS_NATIVE_HISTOGRAMS", "true")
+	InitMetrics()
+	r.processLine(line)
+	for _, name := range []string{"section_http_request_duration_seconds", "section_http_response_size_bytes"} {
+		histogram := gatherHistogram(t, name)
+		assert.Equal(t, uint64(1), histogram.GetSampleCount(), name)
+		// the classic buckets are kept for scrapers without native histograms
+		assert.NotEmpty(t, histogram.GetBucket(), name)
+		assert.Equal(t, int32(3), histogram.GetSchema(), name)
+		assert.Len(t, histogram.GetPositiveSpan(), 1, name)
+		assert.Equal(t, []int64{1}, histogram.GetPositiveDelta(), name)
+	}
+	assert.Equal(t, defaultNativeHistogramBucketFactor, currentDebugConfigBucketFactor(t))
+
+	t.Setenv("MODULE_METRICS_NATIVE_HISTOGRAM_BUCKET_FACTOR", "2")
+	InitMetrics()
+	r.processLine(line)
+	assert.Equal(t, int32(0), gatherHistogram(t, "section_http_response_size_bytes").GetSchema())
+
+	t.Setenv("MODULE_METRICS_NATIVE_HISTOGRAM_BUCKET_FACTOR", "1")
+	InitMetrics()
+	assert.Equal(t, defaultNativeHistogramBucketFactor, nativeHistogramBucketFactor)
+}
+
+func currentDebugConfigBucketFactor(t *testing.T) float64 {
+	config, err := currentDebugConfig()
+	assert.NoError(t, err)
+	return config.NativeHistogramBucketFactor
+}
@@ -3,41 +3,64 @@ package metrics
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	gojsonq "github.com/thedevsaddam/gojsonq/v2"
 	"golang.org/x/exp/slices"
 )
 
 const (
-	metricsAddress     = "0.0.0.0"
+	defaultMetricsHost = "0.0.0.0"
+	unixSocketPrefix   = "unix:"
 	defaultMetricsPath = "/metrics"
 	defaultMetricsPort = "9000"
 	promeSubsystem     = "http"
 	promeNamespace     = "section"
 	hostnameLabel      = "hostname"
 
+	maxHostnamesReached = "max-hostnames-reached"
+
 	aeeHealthcheckLabel = "section_aee_healthcheck"
 )
 
 var (
-	jsonParseErrorTotal prometheus.Counter
-	pageViewTotal       prometheus.Counter
-	requestsTotal       *prometheus.CounterVec
-	bytesTotal          *prometheus.CounterVec
-	registry            *prometheus.Registry
-	httpServer          *http.Server
-
-	requestsByHostnameTotal *prometheus.CounterVec
-	bytesByHostnameTotal    *prometheus.CounterVec
+	jsonParseErrorTotal    *prometheus.CounterVec
+	passthroughLinesTotal  *prometheus.CounterVec
+	fifoReopensTotal       *prometheus.CounterVec
+	oversizedLinesTotal    *prometheus.CounterVec
+	pageViewTotal          *shardedCounterVec
+	requestsTotal          *shardedCounterVec
+	bytesTotal             *shardedCounterVec
+	requestDurationSeconds *prometheus.HistogramVec
+	responseSizeBytes      *prometheus.HistogramVec
+	registry               *prometheus.Registry
+	httpServer             *http.Server
+	httpListener           net.Listener
+
+	linesReadTotal                  *prometheus.CounterVec
+	bytesReadTotal                  *prometheus.CounterVec
+	lineProcessingSeconds           *prometheus.HistogramVec
+	lastLineTimestampSeconds        *prometheus.GaugeVec
+	labelSanitizationFallbacksTotal *prometheus.CounterVec
+	remoteWriteRequestsTotal        *prometheus.CounterVec
+
+	requestsByHostnameTotal *shardedCounterVec
+	bytesByHostnameTotal    *shardedCounterVec
+
+	bytesByGeoTotal    *shardedCounterVec
+	pageViewByGeoTotal *shardedCounterVec
 
 	logFieldNames      []string
 	sanitizedP8sLabels []string
@@ -45,16 +68,31 @@ var (
 	requestLabels      []string
 
 	p8sHTTPServerStarted = false
+	serverDisabled       = false
+
+	// serveMux is what Handler serves, serverErr why InitMetrics couldn't start the server
+	serveMux  atomic.Pointer[http.ServeMux]
+	serverErr error
 
 	// MetricsURI is the address the prometheus server is listening on
 	MetricsURI string
 
 	// vars related to limiting the number of unique hostname labels
+	uniqueHostnameMu   sync.RWMutex
 	uniqueHostnameMap  = make(map[string]struct{})
 	maxUniqueHostnames = 1000
+	// whether a hostname was replaced by the placeholder as the limit was reached
+	uniqueHostnamesOverflowed = false
 
 	includeHostnameMetrics = false
 
+	// opt-in histograms, kept out by default as each of their series is a series per bucket
+	includeRequestHistograms = false
+
+	// opt-in geo_hash metrics, kept apart from bytesTotal so the main bytes series keep their cardinality
+	includeGeoBytesMetrics    = false
+	includeGeoPageViewMetrics = false
+
 	aeeUserAgentRegex = regexp.MustCompile(`^aee/v.+`)
 )
 
@@ -72,63 +110,102 @@ func ShowLabels(log Logf) {
 	log("[INFO] requestLabels %+v", requestLabels)
 }
 
-func extractUserAgent(logline map[string]interface{}) string {
-	userAgent := gojsonq.New().FromInterface(logline).Find("request.http_user_agent")
-	if userAgent != nil {
-		if userAgentStr, ok := userAgent.(string); ok {
-			return userAgentStr
-		}
-	}
-	return ""
+func extractUserAgent(logline map[string]string) string {
+	return logline[userAgentField]
 }
 
-func isPageView(logline map[string]interface{}) bool {
+func isPageView(logline map[string]string) bool {
 	// Count text/html 2XX requests as page-views
-	return strings.HasPrefix(fmt.Sprintf("%v", logline["status"]), "2") &&
-		strings.HasPrefix(strings.ToLower(fmt.Sprintf("%v", logline["content_type"])), "text/html") &&
+	contentType := logline["content_type"]
+	return strings.HasPrefix(logline["status"], "2") &&
+		len(contentType) >= len("text/html") && strings.EqualFold(contentType[:len("text/html")], "text/html") &&
 		!aeeUserAgentRegex.MatchString(extractUserAgent(logline))
 }
 
-func addRequest(labels map[string]string, logline map[string]interface{}) {
+func addRequest(labels map[string]string, logline map[string]string) {
+	addRequestToShard(labels, logline, 0)
+}
+
+// addRequestToShard counts the request in the worker's shard of the counters.
+func addRequestToShard(labels map[string]string, logline map[string]string, worker int) {
 
 	hostname := ""
 	ok := false
 	if hostname, ok = labels[hostnameLabel]; ok {
 		delete(labels, hostnameLabel)
-		_, ok := uniqueHostnameMap[hostname]
-		if !ok {
-			if len(uniqueHostnameMap) < maxUniqueHostnames {
-				uniqueHostnameMap[hostname] = struct{}{}
-			} else {
-				// Use hard-coded hostname so wildcard domains don't make cardinality explode.
-				hostname = "max-hostnames-reached"
-			}
-		}
-
+		hostname = limitHostname(hostname)
 	}
 
 	bytes := float64(getBytes(logline))
 
-	requestsTotal.With(labels).Inc()
+	exemplar := requestExemplar(logline)
+	addWithExemplar(requestsTotal.shard(worker).With(labels), 1, exemplar)
 
 	// remove geo_hash for bytesTotal
 	bytePairs := scrubGeoHash(labels)
-	bytesTotal.With(bytePairs).Add(bytes)
+	bytesTotal.shard(worker).With(bytePairs).Add(bytes)
+	if includeRequestHistograms {
+		responseSizeBytes.With(bytePairs).Observe(bytes)
+		if duration, ok := requestDuration(logline); ok {
+			observeWithExemplar(requestDurationSeconds.With(bytePairs), duration, exemplar)
+		}
+	}
 
-	if isPageView(logline) {
-		pageViewTotal.Inc()
+	pageView := isPageView(logline)
+	if pageView {
+		pageViewTotal.shard(worker).WithLabelValues().Inc()
+	}
+
+	if includeGeoBytesMetrics {
+		bytesByGeoTotal.shard(worker).WithLabelValues(labels[geoHash]).Add(bytes)
+	}
+	if includeGeoPageViewMetrics && pageView {
+		pageViewByGeoTotal.shard(worker).WithLabelValues(labels[geoHash]).Inc()
 	}
 
 	if includeHostnameMetrics {
-		requestsByHostnameTotal.WithLabelValues(hostname).Inc()
-		bytesByHostnameTotal.WithLabelValues(hostname).Add(bytes)
+		addWithExemplar(requestsByHostnameTotal.shard(worker).WithLabelValues(hostname), 1, exemplar)
+		bytesByHostnameTotal.shard(worker).WithLabelValues(hostname).Add(bytes)
 	}
 }
 
+// limitHostname returns the hostname, or a placeholder once maxUniqueHostnames have been seen.
+func limitHostname(hostname string) string {
+	uniqueHostnameMu.RLock()
+	_, ok := uniqueHostnameMap[hostname]
+	uniqueHostnameMu.RUnlock()
+	if ok {
+		return hostname
+	}
+
+	uniqueHostnameMu.Lock()
+	defer uniqueHostnameMu.Unlock()
+	if _, ok := uniqueHostnameMap[hostname]; ok {
+		return hostname
+	}
+	if len(uniqueHostnameMap) < maxUniqueHostnames {
+		uniqueHostnameMap[hostname] = struct{}{}
+		return hostname
+	}
+	// Use hard-coded hostname so wildcard domains don't make cardinality explode.
+	uniqueHostnamesOverflowed = true
+	return maxHostnamesReached
+}
+
+// SetupMetrics is InitMetrics returning the error starting the built-in server, the metrics
+// are set up even if it couldn't be started.
+func SetupMetrics(additionalLabels ...string) (*prometheus.Registry, error) {
+	registry := InitMetrics(additionalLabels...)
+	return registry, serverErr
+}
+
 // InitMetrics sets up the prometheus registry and creates the metrics. Calling this
 // will reset any collected metrics. Returns the registry so additional metrics can be registered.
+// It also (re)starts the built-in server unless it is disabled, an error starting it is only
+// logged, use SetupMetrics or ServerError to get it.
 func InitMetrics(additionalLabels ...string) *prometheus.Registry {
 	logFieldNames = additionalLabels
+	setExtractedFields(additionalLabels)
 	includeHostnameMetrics = false
 
 	// iterate over any additionalLabels passed during metrics initialization & sanitize them (if we have rules defined)
@@ -145,6 +222,11 @@ func InitMetrics(additionalLabels ...string) *prometheus.Registry {
 		sanitizedP8sLabels = slices.Delete(sanitizedP8sLabels, idx, idx+1)
 	}
 
+	// With multiple inputs the metrics are split by the input they were read from.
+	if includeSourceLabel && !slices.Contains(sanitizedP8sLabels, sourceLabel) {
+		sanitizedP8sLabels = append(sanitizedP8sLabels, sourceLabel)
+	}
+
 	requestLabels = sanitizedP8sLabels
 	requestLabels = append(requestLabels, aeeHealthcheckLabel)
 	if isGeoHashing {
@@ -153,46 +235,156 @@ func InitMetrics(additionalLabels ...string) *prometheus.Registry {
 
 	// request labels has geo_hash only for requests counts (not bytes)
 	// when geo_hash is used, bytes needs doesn't use that label
-	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	requestsTotal = newShardedCounterVec(prometheus.CounterOpts{
 		Namespace: promeNamespace,
 		Subsystem: promeSubsystem,
 		Name:      "request_count_total",
 		Help:      "Total count of HTTP requests.",
 	}, requestLabels)
 
-	bytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	bytesTotal = newShardedCounterVec(prometheus.CounterOpts{
 		Namespace: promeNamespace,
 		Subsystem: promeSubsystem,
 		Name:      "bytes_total",
 		Help:      "Total sum of response bytes.",
 	}, sanitizedP8sLabels)
 
-	pageViewTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	pageViewTotal = newShardedCounterVec(prometheus.CounterOpts{
 		Namespace: promeNamespace,
 		Subsystem: promeSubsystem,
 		Name:      "page_view_total",
 		Help:      "Legacy: Total count of page views.",
-	})
+	}, nil)
 
-	jsonParseErrorTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	jsonParseErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: promeNamespace,
 		Subsystem: promeSubsystem,
 		Name:      "json_parse_errors_total",
-		Help:      "Total count of JSON parsing errors.",
+		Help:      "Total count of JSON parsing errors by reason.",
+	}, []string{"reason"})
+	for _, reason := range parseErrorReasons {
+		jsonParseErrorTotal.WithLabelValues(reason)
+	}
+	setupParseErrorEvents()
+	setupReadiness()
+
+	if adaptiveGeo != nil {
+		adaptiveGeo.reset()
+	}
+
+	passthroughLinesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "passthrough_lines_total",
+		Help:      "Total count of log lines forwarded to or left out of the output, by result.",
+	}, []string{"result"})
+
+	fifoReopensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "fifo_reopens_total",
+		Help:      "Total count of times an input was reopened after its writer closed it or reading failed.",
+	}, []string{sourceLabel})
+
+	oversizedLinesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "oversized_lines_total",
+		Help:      "Total count of log lines longer than the maximum line length.",
+	}, []string{sourceLabel})
+
+	linesReadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "lines_read_total",
+		Help:      "Total count of log lines read from an input.",
+	}, []string{sourceLabel})
+
+	bytesReadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "bytes_read_total",
+		Help:      "Total sum of log bytes read from an input.",
+	}, []string{sourceLabel})
+
+	lineProcessingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "line_processing_seconds",
+		Help:      "Time taken to parse a log line and extract its metrics.",
+		Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 10),
+	}, []string{sourceLabel})
+
+	lastLineTimestampSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "last_line_timestamp_seconds",
+		Help:      "Unix time the last log line was read from an input.",
+	}, []string{sourceLabel})
+
+	labelSanitizationFallbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "label_sanitization_fallbacks_total",
+		Help:      "Total count of label values replaced by a fallback or truncated.",
+	}, []string{"label"})
+
+	remoteWriteRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "remote_write_requests_total",
+		Help:      "Total count of requests pushing the metrics to the remote write endpoint by result.",
+	}, []string{"result"})
+	for _, result := range remoteWriteResults {
+		remoteWriteRequestsTotal.WithLabelValues(result)
+	}
+
+	passthroughQueueLines := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "passthrough_queue_lines",
+		Help:      "Number of log lines buffered for the output.",
+	}, func() float64 {
+		lines, _, _ := asyncWriterStats()
+		return float64(lines)
+	})
+
+	passthroughQueueBytes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "passthrough_queue_bytes",
+		Help:      "Number of log bytes buffered for the output.",
+	}, func() float64 {
+		_, bytes, _ := asyncWriterStats()
+		return float64(bytes)
+	})
+
+	resetClosedDroppedBytes()
+	passthroughDroppedBytesTotal := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: promeNamespace,
+		Subsystem: promeSubsystem,
+		Name:      "passthrough_dropped_bytes_total",
+		Help:      "Total sum of log bytes dropped because the output buffer was full.",
+	}, func() float64 {
+		_, _, dropped := asyncWriterStats()
+		return float64(dropped)
 	})
 
 	registry = prometheus.NewRegistry()
-	registry.MustRegister(requestsTotal, bytesTotal, pageViewTotal, jsonParseErrorTotal)
+	registry.MustRegister(requestsTotal, bytesTotal, pageViewTotal,
+		jsonParseErrorTotal, passthroughLinesTotal, fifoReopensTotal, oversizedLinesTotal, passthroughQueueLines, passthroughQueueBytes, passthroughDroppedBytesTotal,
+		linesReadTotal, bytesReadTotal, lineProcessingSeconds, lastLineTimestampSeconds, labelSanitizationFallbacksTotal,
+		remoteWriteRequestsTotal, collectors.NewBuildInfoCollector())
 
 	if includeHostnameMetrics {
-		requestsByHostnameTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		requestsByHostnameTotal = newShardedCounterVec(prometheus.CounterOpts{
 			Namespace: promeNamespace,
 			Subsystem: promeSubsystem,
 			Name:      "request_count_by_hostname_total",
 			Help:      "Total count of HTTP requests by hostname.",
 		}, []string{hostnameLabel})
 
-		bytesByHostnameTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		bytesByHostnameTotal = newShardedCounterVec(prometheus.CounterOpts{
 			Namespace: promeNamespace,
 			Subsystem: promeSubsystem,
 			Name:      "bytes_by_hostname_total",
@@ -202,6 +394,52 @@ func InitMetrics(additionalLabels ...string) *prometheus.Registry {
 		registry.MustRegister(requestsByHostnameTotal, bytesByHostnameTotal)
 	}
 
+	setupNativeHistograms()
+	includeRequestHistograms = envBool("MODULE_METRICS_REQUEST_HISTOGRAMS")
+	if includeRequestHistograms {
+		requestDurationSeconds = prometheus.NewHistogramVec(withNativeHistogram(prometheus.HistogramOpts{
+			Namespace: promeNamespace,
+			Subsystem: promeSubsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Histogram of the request_time of HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		}), sanitizedP8sLabels)
+
+		responseSizeBytes = prometheus.NewHistogramVec(withNativeHistogram(prometheus.HistogramOpts{
+			Namespace: promeNamespace,
+			Subsystem: promeSubsystem,
+			Name:      "response_size_bytes",
+			Help:      "Histogram of the response bytes of HTTP requests.",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+		}), sanitizedP8sLabels)
+
+		registry.MustRegister(requestDurationSeconds, responseSizeBytes)
+	}
+
+	includeGeoBytesMetrics = isGeoHashing && envBool("MODULE_METRICS_GEO_BYTES")
+	if includeGeoBytesMetrics {
+		bytesByGeoTotal = newShardedCounterVec(prometheus.CounterOpts{
+			Namespace: promeNamespace,
+			Subsystem: promeSubsystem,
+			Name:      "bytes_by_geo_total",
+			Help:      "Total sum of response bytes by geo hash.",
+		}, []string{geoHash})
+
+		registry.MustRegister(bytesByGeoTotal)
+	}
+
+	includeGeoPageViewMetrics = isGeoHashing && envBool("MODULE_METRICS_GEO_PAGE_VIEWS")
+	if includeGeoPageViewMetrics {
+		pageViewByGeoTotal = newShardedCounterVec(prometheus.CounterOpts{
+			Namespace: promeNamespace,
+			Subsystem: promeSubsystem,
+			Name:      "page_view_by_geo_total",
+			Help:      "Total count of page views by geo hash.",
+		}, []string{geoHash})
+
+		registry.MustRegister(pageViewByGeoTotal)
+	}
+
 	maxUniqueHostnamesStr := os.Getenv("MODULE_METRICS_MAX_HOSTNAMES")
 	if maxUniqueHostnamesStr != "" {
 		maxUniqueHostnamesInt, err := strconv.Atoi(maxUniqueHostnamesStr)
@@ -211,43 +449,200 @@ func InitMetrics(additionalLabels ...string) *prometheus.Registry {
 		}
 	}
 
-	go startPrometheusServer(os.Stderr)
+	serveMux.Store(newServeMux())
+	serverErr = nil
+	if !serverDisabled && !envBool("P8S_DISABLE_SERVER") {
+		serverErr = StartServer()
+		if serverErr != nil {
+			log.Printf("[ERROR] %v\n", serverErr)
+		}
+	}
 
 	return registry
 }
 
-func startPrometheusServer(stderr io.Writer) {
+// envBool reports whether the environment variable is set to a true value as understood by strconv.ParseBool.
+func envBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
 
-	if p8sHTTPServerStarted {
-		err := httpServer.Shutdown(context.Background())
-		if err != nil {
-			log.Fatalf("Failed to shutdown HTTP server: %v\n", err)
+// metricsListenAddress returns the network and address the server listens on from
+// P8S_METRICS_ADDRESS and P8S_METRICS_PORT. The address is a host, which is combined with the
+// port, a host and port, eg "[::1]:9100", or "unix:" followed by the path of a Unix socket.
+func metricsListenAddress() (string, string) {
+	address := os.Getenv("P8S_METRICS_ADDRESS")
+	if strings.HasPrefix(address, unixSocketPrefix) {
+		return "unix", strings.TrimPrefix(address, unixSocketPrefix)
+	}
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return "tcp", address
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if host == "" {
+		host = defaultMetricsHost
+	}
+	port := os.Getenv("P8S_METRICS_PORT")
+	if port == "" {
+		port = defaultMetricsPort
+	}
+	return "tcp", net.JoinHostPort(host, port)
+}
+
+// listenMetrics opens the listener of the server, replacing a stale Unix socket file.
+func listenMetrics(network string, address string) (net.Listener, error) {
+	if network == "unix" {
+		err := os.Remove(address)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Remove %s failed: %v", address, err)
 		}
 	}
 
-	metricsPath := os.Getenv("P8S_METRICS_PATH")
-	if metricsPath == "" {
-		metricsPath = defaultMetricsPath
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Listen %s %s failed: %v", network, address, err)
+	}
+
+	if network == "unix" {
+		// Make sure a sidecar running as another user can scrape the socket
+		err = os.Chmod(address, 0666)
+		if err != nil {
+			_ = listener.Close()
+			return nil, errors.Wrapf(err, "Chmod %s failed: %v", address, err)
+		}
 	}
+	return listener, nil
+}
 
-	metricsPort := os.Getenv("P8S_METRICS_PORT")
-	if metricsPort == "" {
-		metricsPort = defaultMetricsPort
+// metricsURIFor returns the URI of the metrics on the listener opened at the address, with the
+// port it got if the address has none. A Unix socket is given as "http+unix://" followed by the
+// escaped path of the socket.
+func metricsURIFor(listener net.Listener, address string, scheme string, metricsPath string) string {
+	tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Sprintf("%s+unix://%s%s", scheme, url.PathEscape(listener.Addr().String()), metricsPath)
 	}
+	host, _, _ := net.SplitHostPort(address)
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port)), metricsPath)
+}
 
-	MetricsURI = fmt.Sprintf("http://%s:%s%s", metricsAddress, metricsPort, metricsPath)
+// envPath returns the path set in the environment variable or the default path.
+func envPath(name string, defaultPath string) string {
+	if path := os.Getenv(name); path != "" {
+		return path
+	}
+	return defaultPath
+}
 
+// newServeMux routes the metrics of the current registry and the enabled debug endpoints.
+func newServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle(metricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle(envPath("P8S_METRICS_PATH", defaultMetricsPath), promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	mux.HandleFunc(envPath("P8S_HEALTHZ_PATH", defaultHealthzPath), healthzHandler)
+	mux.HandleFunc(envPath("P8S_READYZ_PATH", defaultReadyzPath), readyzHandler)
+	if isGeoHashing {
+		mux.HandleFunc(envPath("P8S_GEO_CELLS_PATH", defaultGeoCellsPath), geoCellsHandler)
+	}
+	// opt-in as it serves the tracked hostnames
+	if envBool("MODULE_METRICS_DEBUG_CONFIG") {
+		mux.HandleFunc(envPath("P8S_DEBUG_CONFIG_PATH", defaultDebugConfigPath), debugConfigHandler)
+	}
+	return mux
+}
 
-	httpServer = &http.Server{
-		Addr:    metricsAddress + ":" + metricsPort,
-		Handler: mux,
+// Handler returns the handler of the metrics and the debug endpoints, for programs serving
+// them from their own HTTP server. It serves the metrics of the last InitMetrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux := serveMux.Load()
+		if mux == nil {
+			http.Error(w, "metrics are not initialized", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// DisableServer stops the built-in HTTP server and keeps InitMetrics from starting it, for
+// programs serving Handler themselves. Also set by P8S_DISABLE_SERVER=true.
+func DisableServer() {
+	serverDisabled = true
+	_ = stopServer()
+}
+
+func stopServer() error {
+	if !p8sHTTPServerStarted {
+		return nil
 	}
+	p8sHTTPServerStarted = false
+	err := httpServer.Shutdown(context.Background())
+	// the server only closes the listener once it has started serving it
+	_ = httpListener.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Shutting down HTTP server failed: %v", err)
+	}
+	return nil
+}
 
-	p8sHTTPServerStarted = true
-	_, _ = fmt.Fprintf(stderr, "Listening on %s\n", MetricsURI)
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("[ERROR] failed to start HTTP server: %v\n", err)
+// ServerError returns why InitMetrics couldn't start the built-in server, nil when it is
+// running or disabled.
+func ServerError() error {
+	return serverErr
+}
+
+// StartServer starts the built-in HTTP server serving Handler, replacing the running one if
+// any. The listener is opened before it returns so MetricsURI is the real address.
+func StartServer() error {
+	err := stopServer()
+	if err != nil {
+		return err
+	}
+
+	config := &webConfig{}
+	if webConfigFile := os.Getenv("P8S_WEB_CONFIG_FILE"); webConfigFile != "" {
+		config, err = loadWebConfig(webConfigFile)
+		if err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := config.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	network, address := metricsListenAddress()
+	listener, err := listenMetrics(network, address)
+	if err != nil {
+		return err
 	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	MetricsURI = metricsURIFor(listener, address, scheme, envPath("P8S_METRICS_PATH", defaultMetricsPath))
+
+	server := &http.Server{
+		Handler: newAuthHandler(config, Handler(),
+			envPath("P8S_HEALTHZ_PATH", defaultHealthzPath), envPath("P8S_READYZ_PATH", defaultReadyzPath)),
+		TLSConfig: tlsConfig,
+	}
+	httpServer = server
+	httpListener = listener
+
+	p8sHTTPServerStarted = true
+	_, _ = fmt.Fprintf(os.Stderr, "Listening on %s\n", MetricsURI)
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] HTTP server failed: %v\n", err)
+		}
+	}()
+	return nil
 }
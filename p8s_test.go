@@ -2,9 +2,14 @@ package metrics
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"strings"
 	"testing"
 
@@ -15,19 +20,19 @@ import (
 
 func TestIsPageView(t *testing.T) {
 	var logline = map[string]interface{}{"content_type": "text/html", "status": "200"}
-	assert.True(t, isPageView(logline))
+	assert.True(t, isPageView(parseLogLine(logline)))
 
 	logline = map[string]interface{}{"content_type": "text/html", "status": "201"}
-	assert.True(t, isPageView(logline))
+	assert.True(t, isPageView(parseLogLine(logline)))
 
 	logline = map[string]interface{}{"content_type": "text/css", "status": "200"}
-	assert.False(t, isPageView(logline))
+	assert.False(t, isPageView(parseLogLine(logline)))
 
 	logline = map[string]interface{}{"content_type": "text/html", "status": "404"}
-	assert.False(t, isPageView(logline))
+	assert.False(t, isPageView(parseLogLine(logline)))
 
 	logline = map[string]interface{}{"content_type": "text/html;charset=UTF-8", "status": "200"}
-	assert.True(t, isPageView(logline))
+	assert.True(t, isPageView(parseLogLine(logline)))
 }
 
 func getP8sHTTPResponse(t *testing.T) string {
@@ -190,7 +195,8 @@ func testJSONParseErrors(t *testing.T, stdout *bytes.Buffer) {
 
 	actual := gatherP8sResponse(t)
 
-	assert.Contains(t, actual, `section_http_json_parse_errors_total 3`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="not_an_object"} 1`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="syntax"} 2`)
 }
 
 func testP8sServer(t *testing.T, stdout *bytes.Buffer) {
@@ -339,6 +345,118 @@ func testContentTypeBucket(t *testing.T, stdout *bytes.Buffer) {
 	assert.Contains(t, actual, `section_http_request_count_by_hostname_total{hostname="www.example.com"} 4`)
 }
 
+func testLogEnrichment(t *testing.T, stdout *bytes.Buffer) {
+
+	logs := []string{
+		`{"hostname":"www.example.com","status":"200","content_type":"text/html","request_uri":"/a/path?q=1","request":{"http_user_agent":"aee/v1"}}`,
+		`Not JSON`,
+	}
+
+	isEnrichingLogs = true
+	defer func() { isEnrichingLogs = false }()
+
+	stdout.Reset()
+	InitMetrics("status")
+
+	writeLogs(t, logs)
+
+	outputLines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+
+	assert.Equal(t, []string{
+		`{"hostname":"www.example.com","status":"200","content_type":"text/html","request_uri":"/a/path?q=1","request":{"http_user_agent":"aee/v1"},"content_type_bucket":"html","ua_class":"healthcheck","status_class":"2xx","route":"/a/path"}`,
+		`Not JSON`,
+	}, outputLines)
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="true",status="200"} 1`)
+}
+
+func testLogRedaction(t *testing.T, stdout *bytes.Buffer) {
+
+	logs := []string{
+		`{"hostname":"www.example.com","status":"200","remote_addr":"198.51.100.23","request":"GET /a/path?email=a@b.c HTTP/1.1"}`,
+		`{"hostname":"www.example.com","status":"200","remote_addr":"203.0.113.9"`,
+	}
+
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{
+		{Field: "remote_addr", Action: RedactTruncateIP},
+		{Field: "request", Action: RedactStripQuery},
+	}})
+	defer SetRedaction(RedactionConfig{})
+
+	stdout.Reset()
+	InitMetrics("hostname")
+
+	writeLogs(t, logs)
+
+	outputLines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+
+	assert.Equal(t, []string{
+		`{"hostname":"www.example.com","status":"200","remote_addr":"198.51.100.0","request":"GET /a/path HTTP/1.1"}`,
+	}, outputLines)
+
+	assert.NotContains(t, stdout.String(), "203.0.113.9")
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_by_hostname_total{hostname="www.example.com"} 1`)
+	assert.Contains(t, actual, `section_http_passthrough_lines_total{result="unredactable"} 1`)
+}
+
+func testLogSampling(t *testing.T, stdout *bytes.Buffer) {
+
+	logs := []string{
+		`{"hostname":"www.example.com","status":"200","request":{"http_user_agent":"aee/v1"}}`,
+		`{"hostname":"www.example.com","status":"200","request":{"http_user_agent":"curl/7.68.0"}}`,
+		`{"hostname":"www.example.com","status":"503","request":{"http_user_agent":"aee/v1"}}`,
+		`Not JSON`,
+	}
+
+	SetSampling(
+		SampleRule{Filter: FieldEquals(statusClassField, "5xx"), Rate: 1},
+		SampleRule{Filter: FieldEquals(uaClassField, uaClassHealthcheck), Rate: 0},
+	)
+	defer SetSampling()
+
+	stdout.Reset()
+	InitMetrics("hostname")
+
+	writeLogs(t, logs)
+
+	outputLines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+
+	assert.Equal(t, []string{logs[1], logs[2], logs[3]}, outputLines)
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_by_hostname_total{hostname="www.example.com"} 3`)
+	assert.Contains(t, actual, `section_http_passthrough_lines_total{result="forwarded"} 3`)
+	assert.Contains(t, actual, `section_http_passthrough_lines_total{result="sampled_out"} 1`)
+}
+
+func testLogSinks(t *testing.T, stdout *bytes.Buffer) {
+
+	logs := []string{
+		`{"hostname":"www.example.com","status":"200"}`,
+		`{"hostname":"www.example.com","status":"503"}`,
+		`Not JSON`,
+	}
+
+	var errorLog bytes.Buffer
+	SetSinks(Sink{Name: "errors", Writer: &errorLog, Filter: FieldEquals(statusClassField, "5xx")})
+	defer SetSinks()
+
+	stdout.Reset()
+	InitMetrics("hostname")
+
+	writeLogs(t, logs)
+
+	outputLines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+
+	assert.Equal(t, logs, outputLines)
+	// writes out the lines buffered for the sink
+	SetSinks()
+	assert.Equal(t, logs[1]+"\n", errorLog.String())
+}
+
 func TestReaderRunning(t *testing.T) {
 	stdout := setupReader(t)
 
@@ -354,6 +472,10 @@ func TestReaderRunning(t *testing.T) {
 	t.Run("testAdditionalMetricsAfterInit", func(t *testing.T) { testAdditionalMetricsAfterInit(t, stdout) })
 	t.Run("testPageViews", func(t *testing.T) { testPageViews(t, stdout) })
 	t.Run("testContentTypeBucket", func(t *testing.T) { testContentTypeBucket(t, stdout) })
+	t.Run("testLogEnrichment", func(t *testing.T) { testLogEnrichment(t, stdout) })
+	t.Run("testLogRedaction", func(t *testing.T) { testLogRedaction(t, stdout) })
+	t.Run("testLogSampling", func(t *testing.T) { testLogSampling(t, stdout) })
+	t.Run("testLogSinks", func(t *testing.T) { testLogSinks(t, stdout) })
 
 	// Above test always pass "hostname" as an additionalLabel and test
 	t.Run("testCountersIncreaseWithoutHostnameLabel", func(t *testing.T) { testCountersIncreaseWithoutHostnameLabel(t, stdout) })
@@ -387,7 +509,7 @@ func TestSetupModule(t *testing.T) {
 			labels: []string{"status", "content_type", "hostname"},
 			gatherAndAssert: func(t *testing.T) {
 				actual := gatherP8sResponse(t)
-				assert.Contains(t, actual, `section_http_request_count_total{content_type_bucket="javascript",status="200"} 2`)
+				assert.Contains(t, actual, `section_http_request_count_total{content_type_bucket="javascript",section_aee_healthcheck="false",status="200"} 2`)
 				assert.Contains(t, actual, `section_http_bytes_total{content_type_bucket="html",status="304"} 2864`)
 
 				assert.Contains(t, actual, `section_http_request_count_by_hostname_total{hostname="www.example.com"} 7`)
@@ -399,7 +521,7 @@ func TestSetupModule(t *testing.T) {
 			labels: []string{"status", "content_type"},
 			gatherAndAssert: func(t *testing.T) {
 				actual := gatherP8sResponse(t)
-				assert.Contains(t, actual, `section_http_request_count_total{content_type_bucket="javascript",status="200"} 2`)
+				assert.Contains(t, actual, `section_http_request_count_total{content_type_bucket="javascript",section_aee_healthcheck="false",status="200"} 2`)
 				assert.Contains(t, actual, `section_http_bytes_total{content_type_bucket="html",status="304"} 2864`)
 
 				assert.NotContains(t, actual, `section_http_request_count_by_hostname_total`)
@@ -439,30 +561,66 @@ func TestAddRequestUniqueHostnames(t *testing.T) {
 
 	// first unique hostname
 	labels["hostname"] = "a.foo.com"
-	addRequest(labels, logline)
+	addRequest(labels, parseLogLine(logline))
 	assert.Contains(t, gatherP8sResponse(t), `section_http_request_count_by_hostname_total{hostname="a.foo.com"} 1`)
 	assert.Contains(t, uniqueHostnameMap, "a.foo.com")
 
 	// second unique hostname
 	labels["hostname"] = "b.foo.com"
-	addRequest(labels, logline)
+	addRequest(labels, parseLogLine(logline))
 	assert.Contains(t, gatherP8sResponse(t), `section_http_request_count_by_hostname_total{hostname="b.foo.com"} 1`)
 	assert.Contains(t, uniqueHostnameMap, "b.foo.com")
 
 	// third unique hostname exceeds the maximum
 	labels["hostname"] = "c.foo.com"
-	addRequest(labels, logline)
+	addRequest(labels, parseLogLine(logline))
 	assert.Contains(t, gatherP8sResponse(t), `section_http_request_count_by_hostname_total{hostname="max-hostnames-reached"} 1`)
 	assert.NotContains(t, gatherP8sResponse(t), `section_http_request_count_by_hostname_total{hostname="c.foo.com"} 1`)
 	assert.NotContains(t, uniqueHostnameMap, "c.foo.com")
 
 	// first unique hostname still counted
 	labels["hostname"] = "a.foo.com"
-	addRequest(labels, logline)
+	addRequest(labels, parseLogLine(logline))
 	assert.Contains(t, gatherP8sResponse(t), `section_http_request_count_by_hostname_total{hostname="a.foo.com"} 2`)
 	assert.Contains(t, uniqueHostnameMap, "a.foo.com", "first unique hostname, second request")
 }
 
+func TestAddRequestGeoMetrics(t *testing.T) {
+	isGeoHashing = true
+	defer func() { isGeoHashing = false }()
+
+	t.Setenv("MODULE_METRICS_GEO_BYTES", "true")
+	t.Setenv("MODULE_METRICS_GEO_PAGE_VIEWS", "true")
+	InitMetrics("content_type")
+
+	logline := map[string]interface{}{
+		"bytes":        7,
+		"content_type": "text/html",
+		"status":       "200",
+	}
+
+	addRequest(map[string]string{"content_type_bucket": "html", aeeHealthcheckLabel: "false", geoHash: "r3"}, parseLogLine(logline))
+	addRequest(map[string]string{"content_type_bucket": "html", aeeHealthcheckLabel: "false", geoHash: "r3"}, parseLogLine(logline))
+	addRequest(map[string]string{"content_type_bucket": "html", aeeHealthcheckLabel: "false", geoHash: "u1"}, parseLogLine(logline))
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_bytes_total{content_type_bucket="html"} 21`)
+	assert.Contains(t, actual, `section_http_bytes_by_geo_total{geo_hash="r3"} 14`)
+	assert.Contains(t, actual, `section_http_bytes_by_geo_total{geo_hash="u1"} 7`)
+	assert.Contains(t, actual, `section_http_page_view_by_geo_total{geo_hash="r3"} 2`)
+}
+
+func TestAddRequestGeoMetricsOptIn(t *testing.T) {
+	isGeoHashing = true
+	defer func() { isGeoHashing = false }()
+
+	InitMetrics()
+
+	actual := gatherP8sResponse(t)
+	assert.NotContains(t, actual, `section_http_bytes_by_geo_total`)
+	assert.NotContains(t, actual, `section_http_page_view_by_geo_total`)
+}
+
 func Test_extractUserAgent(t *testing.T) {
 	type args struct {
 		logline map[string]interface{}
@@ -513,7 +671,7 @@ func Test_extractUserAgent(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := extractUserAgent(tt.args.logline); got != tt.want {
+			if got := extractUserAgent(parseLogLine(tt.args.logline)); got != tt.want {
 				t.Errorf("extractUserAgent() = %v, want %v", got, tt.want)
 			}
 		})
@@ -638,9 +796,108 @@ func Test_isPageView(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isPageView(tt.args.logline); got != tt.want {
+			if got := isPageView(parseLogLine(tt.args.logline)); got != tt.want {
 				t.Errorf("isPageView() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestMetricsListenAddress(t *testing.T) {
+	defer os.Unsetenv("P8S_METRICS_ADDRESS")
+	defer os.Unsetenv("P8S_METRICS_PORT")
+
+	cases := []struct {
+		address         string
+		port            string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{"", "", "tcp", "0.0.0.0:9000"},
+		{"", "9100", "tcp", "0.0.0.0:9100"},
+		{"127.0.0.1", "", "tcp", "127.0.0.1:9000"},
+		{"::1", "9100", "tcp", "[::1]:9100"},
+		{"[::]", "", "tcp", "[::]:9000"},
+		{"localhost:9200", "9100", "tcp", "localhost:9200"},
+		{"unix:/run/metrics.sock", "", "unix", "/run/metrics.sock"},
+	}
+	for _, c := range cases {
+		os.Setenv("P8S_METRICS_ADDRESS", c.address)
+		os.Setenv("P8S_METRICS_PORT", c.port)
+		network, address := metricsListenAddress()
+		assert.Equal(t, c.expectedNetwork, network, c.address)
+		assert.Equal(t, c.expectedAddress, address, c.address)
+	}
+}
+
+func TestMetricsServerListeners(t *testing.T) {
+	defer os.Unsetenv("P8S_METRICS_ADDRESS")
+
+	os.Setenv("P8S_METRICS_ADDRESS", "127.0.0.1:0")
+	InitMetrics()
+	assert.Regexp(t, `^http://127\.0\.0\.1:[1-9][0-9]*/metrics$`, MetricsURI)
+	assert.Contains(t, getP8sHTTPResponse(t), "section_http_page_view_total 0")
+
+	socket := path.Join(t.TempDir(), "metrics.sock")
+	os.Setenv("P8S_METRICS_ADDRESS", "unix:"+socket)
+	InitMetrics()
+	assert.Equal(t, "http+unix://"+url.PathEscape(socket)+"/metrics", MetricsURI)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://localhost/metrics")
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), "section_http_page_view_total 0")
+	}
+}
+
+func TestHandlerWithoutServer(t *testing.T) {
+	defer func() { serverDisabled = false }()
+	DisableServer()
+	InitMetrics()
+	assert.False(t, p8sHTTPServerStarted)
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, defaultMetricsPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "section_http_page_view_total 0")
+
+	recorder = httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, defaultHealthzPath, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestStartServerError(t *testing.T) {
+	defer os.Unsetenv("P8S_METRICS_ADDRESS")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	os.Setenv("P8S_METRICS_ADDRESS", listener.Addr().String())
+	InitMetrics()
+	assert.Error(t, ServerError())
+	assert.Error(t, StartServer())
+	registry, err := SetupMetrics()
+	assert.Error(t, err)
+	assert.NotNil(t, registry)
+
+	// the inputs aren't created without a server to read them for
+	fifoPath := path.Join(t.TempDir(), "access.log")
+	assert.Error(t, SetupModule(fifoPath, io.Discard, io.Discard))
+	_, err = os.Stat(fifoPath)
+	assert.True(t, os.IsNotExist(err))
+
+	os.Unsetenv("P8S_METRICS_ADDRESS")
+	_, err = SetupMetrics()
+	assert.NoError(t, err)
+	assert.NoError(t, ServerError())
+	assert.NoError(t, StartServer())
+	assert.Contains(t, getP8sHTTPResponse(t), "section_http_page_view_total 0")
+}
@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The reasons a log line failed to parse, the values of the 'reason' label of
+// json_parse_errors_total.
+const (
+	parseErrorSyntax      = "syntax"
+	parseErrorNotAnObject = "not_an_object"
+	parseErrorEmptyLine   = "empty_line"
+	parseErrorOversized   = "oversized"
+)
+
+var parseErrorReasons = []string{parseErrorSyntax, parseErrorNotAnObject, parseErrorEmptyLine, parseErrorOversized}
+
+const (
+	defaultParseErrorEventsPerSecond = 10
+	parseErrorSampleBytes            = 256
+)
+
+var parseErrorEvents = &eventLimiter{perSecond: defaultParseErrorEventsPerSecond}
+
+// parseError is an error parsing a log line, with the reason it's counted under and the byte
+// offset it was found at.
+type parseError struct {
+	reason  string
+	offset  int
+	message string
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.message, e.offset)
+}
+
+// parseErrorEvent is the JSON written to the error writer for a log line that failed to parse.
+type parseErrorEvent struct {
+	Time            string `json:"time"`
+	Level           string `json:"level"`
+	Message         string `json:"msg"`
+	Source          string `json:"source"`
+	Reason          string `json:"reason"`
+	Offset          *int   `json:"offset,omitempty"`
+	Error           string `json:"error"`
+	Sample          string `json:"sample,omitempty"`
+	SampleTruncated bool   `json:"sample_truncated,omitempty"`
+	Suppressed      int    `json:"suppressed,omitempty"`
+}
+
+// parseErrorReason returns the reason a log line failed to parse, lines that were truncated
+// as they were too long are counted as oversized whatever the error.
+func parseErrorReason(err error, truncated bool) string {
+	if truncated {
+		return parseErrorOversized
+	}
+	if parseErr, ok := errors.Cause(err).(*parseError); ok {
+		return parseErr.reason
+	}
+	return parseErrorSyntax
+}
+
+// reportParseError counts the log line that failed to parse and writes an event about it to
+// the error writer, unless too many have been written in the last second. The event has the
+// start of the line as a sample unless redaction is enabled.
+func (r *reader) reportParseError(line []byte, err error, truncated bool) {
+	reason := parseErrorReason(err, truncated)
+	jsonParseErrorTotal.WithLabelValues(reason).Inc()
+
+	now := time.Now()
+	ok, suppressed := parseErrorEvents.allow(now)
+	if !ok {
+		return
+	}
+
+	event := parseErrorEvent{
+		Time:       now.UTC().Format(time.RFC3339Nano),
+		Level:      "error",
+		Message:    "Parsing log line failed",
+		Source:     r.source,
+		Reason:     reason,
+		Error:      err.Error(),
+		Suppressed: suppressed,
+	}
+	if parseErr, ok := errors.Cause(err).(*parseError); ok {
+		event.Offset = &parseErr.offset
+	}
+	// with redaction the line is left out of the output as it can't be redacted, so of the
+	// event as well
+	if redaction == nil {
+		sample := line
+		if len(sample) > 0 && sample[len(sample)-1] == '\n' {
+			sample = sample[:len(sample)-1]
+		}
+		if len(sample) > parseErrorSampleBytes {
+			sample = sample[:parseErrorSampleBytes]
+			event.SampleTruncated = true
+		}
+		event.Sample = string(sample)
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	r.errorf("%s\n", eventJSON)
+}
+
+// setupParseErrorEvents applies MODULE_METRICS_PARSE_ERROR_EVENTS_PER_SECOND, 0 disables them.
+func setupParseErrorEvents() {
+	perSecond := defaultParseErrorEventsPerSecond
+	if perSecondStr := os.Getenv("MODULE_METRICS_PARSE_ERROR_EVENTS_PER_SECOND"); perSecondStr != "" {
+		value, err := strconv.Atoi(perSecondStr)
+		if err == nil && value >= 0 {
+			perSecond = value
+		}
+	}
+	parseErrorEvents.reset(perSecond)
+}
+
+// eventLimiter allows up to perSecond events in each second, counting the ones it suppressed.
+type eventLimiter struct {
+	mu          sync.Mutex
+	perSecond   int
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+func (l *eventLimiter) reset(perSecond int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.perSecond = perSecond
+	l.windowStart = time.Time{}
+	l.count = 0
+	l.suppressed = 0
+}
+
+// allow reports whether an event can be written now, along with the number suppressed since
+// the last one that was.
+func (l *eventLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.windowStart = now
+		l.count = 0
+	}
+	if l.count >= l.perSecond {
+		l.suppressed++
+		return false, 0
+	}
+	l.count++
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportParseError(t *testing.T) {
+	InitMetrics()
+
+	long := `{"status":` + strings.Repeat("9", 300)
+	logs := `{"status" "200"}` + "\n" + "\n" + `["status"]` + "\n" + long + "\n"
+
+	var stderr bytes.Buffer
+	r := &reader{source: "test", parser: JSONParser, output: io.Discard, errorWriter: &stderr}
+	r.run(io.NopCloser(strings.NewReader(logs)))
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="syntax"} 2`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="empty_line"} 1`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="not_an_object"} 1`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="oversized"} 0`)
+
+	var events []parseErrorEvent
+	for _, line := range strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n") {
+		var event parseErrorEvent
+		assert.NoError(t, json.Unmarshal([]byte(line), &event), line)
+		events = append(events, event)
+	}
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, "test", events[0].Source)
+		assert.Equal(t, "syntax", events[0].Reason)
+		assert.Equal(t, 10, *events[0].Offset)
+		assert.Equal(t, `{"status" "200"}`, events[0].Sample)
+		assert.False(t, events[0].SampleTruncated)
+		assert.Contains(t, events[0].Error, "JSON parsing failed")
+
+		assert.Equal(t, "empty_line", events[1].Reason)
+		assert.Equal(t, "not_an_object", events[2].Reason)
+
+		assert.Equal(t, long[:parseErrorSampleBytes], events[3].Sample)
+		assert.True(t, events[3].SampleTruncated)
+		assert.Equal(t, len(long)+1, *events[3].Offset)
+	}
+}
+
+func TestReportParseErrorRedacted(t *testing.T) {
+	InitMetrics()
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{{Field: "client_ip", Action: RedactDrop}}})
+	defer SetRedaction(RedactionConfig{})
+
+	var stdout, stderr bytes.Buffer
+	r := &reader{source: "test", parser: JSONParser, output: &stdout, errorWriter: &stderr}
+	r.processLine([]byte(`{"client_ip":"203.0.113.9","status":200` + "\n"))
+
+	assert.Empty(t, stdout.String())
+	assert.NotContains(t, stderr.String(), "203.0.113.9")
+	var event parseErrorEvent
+	assert.NoError(t, json.Unmarshal(stderr.Bytes(), &event))
+	assert.Equal(t, "syntax", event.Reason)
+	assert.Empty(t, event.Sample)
+	assert.NotContains(t, stderr.String(), `"sample"`)
+}
+
+func TestParseErrorReason(t *testing.T) {
+	_, err := JSONParser([]byte(`{"status":`))
+	assert.Equal(t, parseErrorSyntax, parseErrorReason(err, false))
+	assert.Equal(t, parseErrorOversized, parseErrorReason(err, true))
+
+	_, err = RegexParser(regexp.MustCompile(`^(?P<level>\w+): `))([]byte("no match"))
+	assert.Equal(t, parseErrorSyntax, parseErrorReason(err, false))
+}
+
+func TestEventLimiter(t *testing.T) {
+	l := &eventLimiter{perSecond: 2}
+	now := time.Now()
+
+	for i, expected := range []bool{true, true, false, false} {
+		ok, suppressed := l.allow(now.Add(time.Duration(i) * time.Millisecond))
+		assert.Equal(t, expected, ok)
+		assert.Equal(t, 0, suppressed)
+	}
+
+	ok, suppressed := l.allow(now.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 2, suppressed)
+
+	l.reset(0)
+	ok, _ = l.allow(now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,315 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// RedactionAction is what a RedactionRule does to the value of a log field.
+type RedactionAction int
+
+const (
+	// RedactDrop removes the field from the log line.
+	RedactDrop RedactionAction = iota
+	// RedactHashIP replaces IP addresses with a salted hash, so requests can still be correlated.
+	RedactHashIP
+	// RedactTruncateIP zeroes the host part of IP addresses, eg to a /24 for IPv4 and a /48 for IPv6.
+	RedactTruncateIP
+	// RedactStripQuery removes the query string from a URL or request line.
+	RedactStripQuery
+)
+
+const (
+	defaultRedactIPv4PrefixLength = 24
+	defaultRedactIPv6PrefixLength = 48
+	redactedValue                 = "-"
+)
+
+// RedactionRule applies an action to a field of the log lines written to the output.
+type RedactionRule struct {
+	// Field is the name of the log field, nested fields are separated by dots, eg "request.http_user_agent".
+	Field  string
+	Action RedactionAction
+}
+
+// RedactionConfig is the set of redaction rules applied to the passthrough logs.
+type RedactionConfig struct {
+	Rules []RedactionRule
+	// Salt is the key used when hashing IP addresses, it has to be secret for the hashes not to be
+	// reversed by hashing every IPv4 address.
+	Salt string
+	// IPv4PrefixLength is the number of bits kept when truncating IPv4 addresses, defaults to 24.
+	IPv4PrefixLength int
+	// IPv6PrefixLength is the number of bits kept when truncating IPv6 addresses, defaults to 48.
+	IPv6PrefixLength int
+
+	// the rules compiled by SetRedaction, the actions are keyed by field
+	paths   fieldPaths
+	actions map[string][]RedactionAction
+}
+
+var redaction *RedactionConfig
+
+// SetRedaction applies the rules to every JSON log line written to the output. The metrics are
+// still extracted from the original log line. Lines that are not valid JSON are left out of the
+// output. Calling it with no rules disables redaction.
+func SetRedaction(config RedactionConfig) {
+	if len(config.Rules) == 0 {
+		redaction = nil
+		return
+	}
+	if config.IPv4PrefixLength <= 0 || config.IPv4PrefixLength > 32 {
+		config.IPv4PrefixLength = defaultRedactIPv4PrefixLength
+	}
+	if config.IPv6PrefixLength <= 0 || config.IPv6PrefixLength > 128 {
+		config.IPv6PrefixLength = defaultRedactIPv6PrefixLength
+	}
+
+	fields := make([]string, 0, len(config.Rules))
+	config.actions = make(map[string][]RedactionAction, len(config.Rules))
+	for _, rule := range config.Rules {
+		fields = append(fields, rule.Field)
+		config.actions[rule.Field] = append(config.actions[rule.Field], rule.Action)
+		if rule.Action == RedactHashIP && config.Salt == "" {
+			log.Printf("[WARN] Redaction rule for %s hashes IP addresses without a Salt, they can be recovered by hashing every address\n", rule.Field)
+		}
+	}
+	config.paths = compileFieldPaths(fields)
+	addLiteralFieldPaths(config.paths, fields)
+	redaction = &config
+}
+
+// redactLine returns the line with the redaction rules applied. The fields are edited in place,
+// everything else, including the key order and spacing, is kept as it was written.
+func (config *RedactionConfig) redactLine(line []byte) []byte {
+	r := &redactor{config: config, scanner: fieldScanner{line: line}}
+	r.out.Grow(len(line))
+
+	s := &r.scanner
+	s.skipSpace()
+	if s.pos == len(line) || line[s.pos] != '{' {
+		return line
+	}
+	r.out.Write(line[:s.pos])
+	if err := r.object(config.paths); err != nil {
+		return line
+	}
+	r.out.Write(line[s.pos:])
+	return r.out.Bytes()
+}
+
+// redactor copies a JSON log line, replacing or leaving out the values of the redacted fields.
+type redactor struct {
+	config  *RedactionConfig
+	scanner fieldScanner
+	out     bytes.Buffer
+}
+
+// object copies the object at the current position, applying the actions of the fields in paths.
+func (r *redactor) object(paths fieldPaths) error {
+	s := &r.scanner
+	start := s.pos
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	s.skipSpace()
+	r.out.Write(s.line[start:s.pos])
+	if s.pos < len(s.line) && s.line[s.pos] == '}' {
+		s.pos++
+		r.out.WriteByte('}')
+		return nil
+	}
+
+	kept := 0
+	// the comma and spacing written before the member, unless it is the first one kept
+	var separator []byte
+	for {
+		memberStart := s.pos
+		if s.pos == len(s.line) || s.line[s.pos] != '"' {
+			return s.errorf("invalid character looking for beginning of object key string")
+		}
+		key, escaped, err := s.str()
+		if err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		s.skipSpace()
+
+		var node *fieldPath
+		if escaped {
+			node = paths[unescape(key)]
+		} else {
+			node = paths[string(key)]
+		}
+		actions := r.config.actions[nodePath(node)]
+
+		if slices.Contains(actions, RedactDrop) {
+			err = s.skipValue()
+		} else {
+			if kept > 0 {
+				r.out.Write(separator)
+			}
+			kept++
+			r.out.Write(s.line[memberStart:s.pos])
+			err = r.value(node, actions)
+		}
+		if err != nil {
+			return err
+		}
+
+		memberEnd := s.pos
+		s.skipSpace()
+		if s.pos == len(s.line) {
+			return s.errorf("unexpected end of JSON input")
+		}
+		switch s.line[s.pos] {
+		case ',':
+			s.pos++
+			s.skipSpace()
+			separator = s.line[memberEnd:s.pos]
+		case '}':
+			s.pos++
+			r.out.Write(s.line[memberEnd:s.pos])
+			return nil
+		default:
+			return s.errorf("invalid character %q after object key:value pair", s.line[s.pos])
+		}
+	}
+}
+
+// value copies the value at the current position, applying the actions to a string or
+// descending into an object holding redacted fields.
+func (r *redactor) value(node *fieldPath, actions []RedactionAction) error {
+	s := &r.scanner
+	if s.pos == len(s.line) {
+		return s.errorf("unexpected end of JSON input")
+	}
+	start := s.pos
+
+	switch {
+	case s.line[s.pos] == '{' && node != nil && node.children != nil:
+		return r.object(node.children)
+	case s.line[s.pos] == '"' && len(actions) > 0:
+		raw, escaped, err := s.str()
+		if err != nil {
+			return err
+		}
+		value := string(raw)
+		if escaped {
+			value = unescape(raw)
+		}
+		redacted := value
+		for _, action := range actions {
+			redacted = r.config.apply(action, redacted)
+		}
+		if redacted == value {
+			r.out.Write(s.line[start:s.pos])
+			return nil
+		}
+		return writeJSONString(&r.out, redacted)
+	default:
+		if err := s.skipValue(); err != nil {
+			return err
+		}
+		r.out.Write(s.line[start:s.pos])
+		return nil
+	}
+}
+
+func nodePath(node *fieldPath) string {
+	if node == nil || !node.wanted {
+		return ""
+	}
+	return node.path
+}
+
+// apply returns the string value of a field with the action applied.
+func (config *RedactionConfig) apply(action RedactionAction, value string) string {
+	switch action {
+	case RedactHashIP:
+		return mapAddresses(value, config.hashIP)
+	case RedactTruncateIP:
+		return mapAddresses(value, config.truncateIP)
+	case RedactStripQuery:
+		return stripQuery(value)
+	}
+	return value
+}
+
+// writeJSONString writes the value as a JSON string, without escaping HTML characters.
+func writeJSONString(out *bytes.Buffer, value string) error {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	// Encode always adds a newline
+	out.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
+	return nil
+}
+
+// mapAddresses applies fn to each address of a comma separated list, eg X-Forwarded-For.
+func mapAddresses(value string, fn func(string) string) string {
+	if value == "" || value == redactedValue {
+		return value
+	}
+	addresses := strings.Split(value, ",")
+	for i, address := range addresses {
+		addresses[i] = fn(strings.TrimSpace(address))
+	}
+	return strings.Join(addresses, ", ")
+}
+
+func (config *RedactionConfig) hashIP(address string) string {
+	mac := hmac.New(sha256.New, []byte(config.Salt))
+	_, _ = mac.Write([]byte(address))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (config *RedactionConfig) truncateIP(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return redactedValue
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		host = ip4.Mask(net.CIDRMask(config.IPv4PrefixLength, 32)).String()
+	} else {
+		host = ip.Mask(net.CIDRMask(config.IPv6PrefixLength, 128)).String()
+	}
+
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+// stripQuery removes the query string, keeping anything after it in a request line
+// eg "GET /path?a=b HTTP/1.1" becomes "GET /path HTTP/1.1"
+func stripQuery(value string) string {
+	start := strings.IndexByte(value, '?')
+	if start < 0 {
+		return value
+	}
+	end := strings.IndexAny(value[start:], " \t")
+	if end < 0 {
+		return value[:start]
+	}
+	return value[:start] + value[start+end:]
+}
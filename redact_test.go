@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactLine(t *testing.T) {
+	SetRedaction(RedactionConfig{
+		Rules: []RedactionRule{
+			{Field: "remote_addr", Action: RedactTruncateIP},
+			{Field: "http_x_forwarded_for", Action: RedactTruncateIP},
+			{Field: "upstream_addr", Action: RedactTruncateIP},
+			{Field: "client_ip", Action: RedactHashIP},
+			{Field: "request", Action: RedactStripQuery},
+			{Field: "geo.city", Action: RedactDrop},
+			{Field: "not.present", Action: RedactDrop},
+		},
+		Salt: "pepper",
+	})
+	defer SetRedaction(RedactionConfig{})
+
+	line := `{"remote_addr":"2001:db8:abcd:12:ffff::1","http_x_forwarded_for":"198.51.100.23, 203.0.113.9","upstream_addr":"198.51.100.1:443","client_ip":"198.51.100.23","request":"GET /a/path?email=a@b.c HTTP/1.1","bytes":12345,"geo":{"city":"Sydney","latlon":"-33.86,151.21"},"html":"<b>"}` + "\n"
+
+	actual := redaction.redactLine([]byte(line))
+
+	assert.Equal(t,
+		`{"remote_addr":"2001:db8:abcd::","http_x_forwarded_for":"198.51.100.0, 203.0.113.0","upstream_addr":"198.51.100.0:443","client_ip":"`+redaction.hashIP("198.51.100.23")+`","request":"GET /a/path HTTP/1.1","bytes":12345,"geo":{"latlon":"-33.86,151.21"},"html":"<b>"}`+"\n",
+		string(actual))
+}
+
+func TestRedactLineKeepsFormatting(t *testing.T) {
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{
+		{Field: "remote_addr", Action: RedactTruncateIP},
+		{Field: "a", Action: RedactDrop},
+		{Field: "geo.city", Action: RedactDrop},
+		{Field: "z", Action: RedactDrop},
+	}})
+	defer SetRedaction(RedactionConfig{})
+
+	line := `{ "a": 1, "z" : [1,2], "remote_addr" : "198.51.100.23", "b":{"x": null}, "geo": { "city": "Sydney" }, "n": 1.50 }`
+	assert.Equal(t,
+		`{ "remote_addr" : "198.51.100.0", "b":{"x": null}, "geo": {  }, "n": 1.50 }`,
+		string(redaction.redactLine([]byte(line))))
+
+	line = `{"remote_addr":"198.51.100.23","a":1}  {"remote_addr":"198.51.100.23"}` + "\n"
+	assert.Equal(t,
+		`{"remote_addr":"198.51.100.0"}  {"remote_addr":"198.51.100.23"}`+"\n",
+		string(redaction.redactLine([]byte(line))))
+
+	line = `{"geo.city":"Sydney","geo":{"city":"Sydney"}}`
+	assert.Equal(t, `{"geo":{}}`, string(redaction.redactLine([]byte(line))))
+
+	line = `{"remote_addr":"\u0031\u0039\u0038.51.100.23","b":"\u00e9"}`
+	assert.Equal(t, `{"remote_addr":"198.51.100.0","b":"\u00e9"}`, string(redaction.redactLine([]byte(line))))
+}
+
+func TestRedactLineNotJSON(t *testing.T) {
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{{Field: "request", Action: RedactDrop}}})
+	defer SetRedaction(RedactionConfig{})
+
+	assert.Equal(t, "Not JSON\n", string(redaction.redactLine([]byte("Not JSON\n"))))
+	assert.Equal(t, `{"request":"/"`, string(redaction.redactLine([]byte(`{"request":"/"`))))
+	assert.Equal(t, `{}`, string(redaction.redactLine([]byte(`{"request":"/"}`))))
+}
+
+func TestRedactHashIP(t *testing.T) {
+	salted := RedactionConfig{Salt: "a"}
+	otherSalt := RedactionConfig{Salt: "b"}
+
+	assert.Equal(t, salted.hashIP("198.51.100.23"), salted.hashIP("198.51.100.23"))
+	assert.NotEqual(t, salted.hashIP("198.51.100.23"), salted.hashIP("198.51.100.24"))
+	assert.NotEqual(t, salted.hashIP("198.51.100.23"), otherSalt.hashIP("198.51.100.23"))
+	assert.NotContains(t, salted.hashIP("198.51.100.23"), "198.51.100")
+}
+
+func TestRedactHashIPWithoutSalt(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer SetRedaction(RedactionConfig{})
+
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{{Field: "client_ip", Action: RedactHashIP}}, Salt: "pepper"})
+	assert.Empty(t, logs.String())
+
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{
+		{Field: "remote_addr", Action: RedactTruncateIP},
+		{Field: "client_ip", Action: RedactHashIP},
+	}})
+	assert.Contains(t, logs.String(), "[WARN] Redaction rule for client_ip hashes IP addresses without a Salt")
+	assert.NotContains(t, logs.String(), "remote_addr")
+}
+
+func TestRedactTruncateIP(t *testing.T) {
+	SetRedaction(RedactionConfig{
+		Rules:            []RedactionRule{{Field: "remote_addr", Action: RedactTruncateIP}},
+		IPv4PrefixLength: 16,
+		IPv6PrefixLength: 32,
+	})
+	defer SetRedaction(RedactionConfig{})
+
+	assert.Equal(t, "198.51.0.0", redaction.truncateIP("198.51.100.23"))
+	assert.Equal(t, "2001:db8::", redaction.truncateIP("2001:db8:abcd:12::1"))
+	assert.Equal(t, "[2001:db8::]:443", redaction.truncateIP("[2001:db8:abcd:12::1]:443"))
+	assert.Equal(t, redactedValue, redaction.truncateIP("unknown"))
+	assert.Equal(t, redactedValue, mapAddresses(redactedValue, redaction.truncateIP))
+}
+
+func TestStripQuery(t *testing.T) {
+	assert.Equal(t, "/a/path", stripQuery("/a/path?q=1"))
+	assert.Equal(t, "GET /a/path HTTP/1.1", stripQuery("GET /a/path?q=1&r=2 HTTP/1.1"))
+	assert.Equal(t, "GET /a/path HTTP/1.1", stripQuery("GET /a/path HTTP/1.1"))
+	assert.Equal(t, "https://example.com/", stripQuery("https://example.com/?"))
+}
+
+func TestSetRedactionDefaults(t *testing.T) {
+	SetRedaction(RedactionConfig{Rules: []RedactionRule{{Field: "remote_addr", Action: RedactTruncateIP}}})
+	defer SetRedaction(RedactionConfig{})
+
+	assert.Equal(t, defaultRedactIPv4PrefixLength, redaction.IPv4PrefixLength)
+	assert.Equal(t, defaultRedactIPv6PrefixLength, redaction.IPv6PrefixLength)
+
+	SetRedaction(RedactionConfig{})
+	assert.Nil(t, redaction)
+}
@@ -41,7 +41,7 @@ func (c coords) isValid() bool {
 		c.convertError == nil
 }
 
-func (c coords) logErrors(logline map[string]interface{}, logf func(f string, args ...interface{})) {
+func (c coords) logErrors(logline map[string]string, logf func(f string, args ...interface{})) {
 	if c.missingGeo {
 		logf("missing geo object (geo: %+v)", logline[geoHash])
 	}
@@ -66,17 +66,17 @@ func convertLatLon(rawLat, rawLon string) (float64, float64, error) {
 	return lat, lon, nil
 }
 
-func extractGeoip(logline map[string]interface{}) coords {
+func extractGeoip(logline map[string]string) coords {
 	rawGeo, ok := logline["geo"]
 	if !ok {
 		return missingLogFields
 	}
-	geo, isMap := rawGeo.(map[string]interface{})
+	// objects are extracted as their JSON text
+	isMap := strings.HasPrefix(rawGeo, "{")
 	if !isMap {
 		return missingLogFields
 	}
-	rawLatLon, hasLatLon := geo["latlon"]
-	latlon, isLatLonString := rawLatLon.(string)
+	latlon, hasLatLon := logline[geoLatLonField]
 	rawLat, rawLon, extractErr := extractLatLon(latlon)
 	lat, lon, convertErr := convertLatLon(rawLat, rawLon)
 	return coords{
@@ -84,7 +84,7 @@ func extractGeoip(logline map[string]interface{}) coords {
 		lon:           lon,
 		rawLat:        rawLat,
 		rawLon:        rawLon,
-		missingLatLon: !isLatLonString && !hasLatLon,
+		missingLatLon: !hasLatLon,
 		missingGeo:    !isMap,
 		extractError:  extractErr,
 		convertError:  convertErr,
@@ -106,7 +106,7 @@ func extractLatLon(latlon string) (string, string, error) {
 	return lat, lon, nil
 }
 
-func convertLatLonToHash(labels map[string]string, logline map[string]interface{}) (map[string]string, coords) {
+func convertLatLonToHash(labels map[string]string, logline map[string]string) (map[string]string, coords) {
 	if labels == nil {
 		return map[string]string{geoHash: geoMissing}, coords{}
 	}
@@ -115,11 +115,17 @@ func convertLatLonToHash(labels map[string]string, logline map[string]interface{
 		labels[geoHash] = geoMissing
 		return labels, c
 	}
-	hash := geohash.EncodeWithPrecision(c.lat, c.lon, effectiveHashPrecision)
-	labels[geoHash] = hash
+	labels[geoHash] = encodeGeoHash(c.lat, c.lon)
 	return labels, c
 }
 
+func encodeGeoHash(lat, lon float64) string {
+	if adaptiveGeo != nil {
+		return adaptiveGeo.hash(lat, lon)
+	}
+	return geohash.EncodeWithPrecision(lat, lon, effectiveHashPrecision)
+}
+
 // scrubGeoHash must create a new map since the values of the
 // provided map could be used at some future time after having been
 // previously provided to other calls since passed by pointer
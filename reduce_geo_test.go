@@ -30,7 +30,7 @@ func TestConvertLatLon_ProducesValidCoords(t *testing.T) {
 		{message: "only no precision", logline: mockLogLineWithGeo(".1,.2")},
 	}
 	for _, c := range cases {
-		labels, c := convertLatLonToHash(emptyLabels, c.logline)
+		labels, c := convertLatLonToHash(emptyLabels, parseLogLine(c.logline))
 		assert.True(t, c.isValid(), "expected an valid coord %+v", c)
 		_, ok := labels[geoHash]
 		assert.True(t, ok)
@@ -53,9 +53,9 @@ func TestConvertLatLon_ProducesInvalidCoords(t *testing.T) {
 		}},
 	}
 	for _, c := range cases {
-		_, coord := convertLatLonToHash(emptyLabels, c.logline)
+		_, coord := convertLatLonToHash(emptyLabels, parseLogLine(c.logline))
 		assert.False(t, coord.isValid(), "expected an invalid coord %+v", c)
-		coord.logErrors(c.logline, t.Logf)
+		coord.logErrors(parseLogLine(c.logline), t.Logf)
 	}
 }
 
@@ -196,7 +196,7 @@ func TestExtractGeoIp(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		latlon := extractGeoip(c.logline)
+		latlon := extractGeoip(parseLogLine(c.logline))
 		if c.isZero {
 			assert.True(t, latlon.isZero(), "coord: %+v", latlon)
 			continue
@@ -235,7 +235,7 @@ func TestExtractGeoIp(t *testing.T) {
 			t, c.expected.rawLon, latlon.rawLon,
 			"message: %s, actual: %+v", c.message, latlon)
 
-		labels, _ := convertLatLonToHash(nil, c.logline)
+		labels, _ := convertLatLonToHash(nil, parseLogLine(c.logline))
 		assert.NotNil(t, labels)
 		_, hasHash := labels[geoHash]
 		assert.True(t, hasHash,
@@ -247,14 +247,14 @@ func TestExtractGeoIp(t *testing.T) {
 func TestConvertLatLonToHash_HandlesNilLabels(t *testing.T) {
 	var currentLabels map[string]string
 	var logline map[string]interface{}
-	labels, _ := convertLatLonToHash(currentLabels, logline)
+	labels, _ := convertLatLonToHash(currentLabels, parseLogLine(logline))
 	assert.NotNil(t, labels)
 }
 
 func TestConvertLatLonToHash_HandlesNilLogLine(t *testing.T) {
 	currentLabels := map[string]string{}
 	var logline map[string]interface{}
-	labels, _ := convertLatLonToHash(currentLabels, logline)
+	labels, _ := convertLatLonToHash(currentLabels, parseLogLine(logline))
 	assert.NotNil(t, labels)
 }
 
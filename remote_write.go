@@ -0,0 +1,375 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultRemoteWriteInterval   = 30 * time.Second
+	defaultRemoteWriteTimeout    = 10 * time.Second
+	defaultRemoteWriteQueueSize  = 10
+	defaultRemoteWriteMaxRetries = 5
+
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+// the results a remote write request is counted by
+var remoteWriteResults = []string{"success", "retried", "failed", "dropped"}
+
+var (
+	// remoteWriteMinBackoff is the wait before the first retry, doubled for every next one
+	remoteWriteMinBackoff = 500 * time.Millisecond
+
+	remoteWriterMu sync.Mutex
+	remoteWriter   *pushWriter
+)
+
+// pushWriter periodically gathers the registry and pushes it to a Prometheus remote write
+// endpoint. The requests waiting to be sent are only kept in memory, the oldest is dropped
+// once the queue is full.
+type pushWriter struct {
+	url            string
+	redactedURL    string
+	interval       time.Duration
+	maxRetries     int
+	externalLabels map[string]string
+	client         *http.Client
+	gather         func() ([]*dto.MetricFamily, error)
+
+	// snappy compressed WriteRequests waiting to be sent
+	queue chan []byte
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+// StartRemoteWrite starts pushing the metrics to MODULE_METRICS_REMOTE_WRITE_URL, if it is set,
+// stopping the previous remote writer.
+func StartRemoteWrite() error {
+	StopRemoteWrite()
+
+	rawURL := os.Getenv("MODULE_METRICS_REMOTE_WRITE_URL")
+	if rawURL == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(rawURL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return errors.New("MODULE_METRICS_REMOTE_WRITE_URL is not an http or https URL")
+	}
+
+	w := &pushWriter{
+		url:         endpoint.String(),
+		redactedURL: endpoint.Redacted(),
+		interval:    defaultRemoteWriteInterval,
+		maxRetries:  defaultRemoteWriteMaxRetries,
+		client:      &http.Client{Timeout: defaultRemoteWriteTimeout},
+		gather:      func() ([]*dto.MetricFamily, error) { return registry.Gather() },
+	}
+	queueSize := defaultRemoteWriteQueueSize
+
+	if w.interval, err = envDuration("MODULE_METRICS_REMOTE_WRITE_INTERVAL", w.interval); err != nil {
+		return err
+	}
+	if w.client.Timeout, err = envDuration("MODULE_METRICS_REMOTE_WRITE_TIMEOUT", w.client.Timeout); err != nil {
+		return err
+	}
+	if queueSize, err = envInt("MODULE_METRICS_REMOTE_WRITE_QUEUE_SIZE", queueSize, 1); err != nil {
+		return err
+	}
+	if w.maxRetries, err = envInt("MODULE_METRICS_REMOTE_WRITE_MAX_RETRIES", w.maxRetries, 0); err != nil {
+		return err
+	}
+	if w.externalLabels, err = parseExternalLabels(os.Getenv("MODULE_METRICS_REMOTE_WRITE_EXTERNAL_LABELS")); err != nil {
+		return err
+	}
+
+	w.start(queueSize)
+	remoteWriterMu.Lock()
+	remoteWriter = w
+	remoteWriterMu.Unlock()
+	log.Printf("[INFO] Pushing metrics to %s every %s\n", w.redactedURL, w.interval)
+	return nil
+}
+
+// StopRemoteWrite stops pushing the metrics, dropping the requests not sent yet.
+func StopRemoteWrite() {
+	remoteWriterMu.Lock()
+	w := remoteWriter
+	remoteWriter = nil
+	remoteWriterMu.Unlock()
+
+	if w != nil {
+		close(w.stop)
+		w.done.Wait()
+	}
+}
+
+func envDuration(name string, value time.Duration) (time.Duration, error) {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return value, nil
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil || value <= 0 {
+		return 0, errors.Errorf("%s %s is not a positive duration", name, valueStr)
+	}
+	return value, nil
+}
+
+func envInt(name string, value int, minimum int) (int, error) {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return value, nil
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < minimum {
+		return 0, errors.Errorf("%s %s is not a number of at least %d", name, valueStr, minimum)
+	}
+	return value, nil
+}
+
+// parseExternalLabels parses the labels added to every pushed series, eg "region=eu,node=edge-1".
+func parseExternalLabels(labels string) (map[string]string, error) {
+	externalLabels := map[string]string{}
+	for _, pair := range strings.Split(labels, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			return nil, errors.Errorf("External label %s is invalid", pair)
+		}
+		externalLabels[name] = strings.TrimSpace(value)
+	}
+	return externalLabels, nil
+}
+
+func (w *pushWriter) start(queueSize int) {
+	w.queue = make(chan []byte, queueSize)
+	w.stop = make(chan struct{})
+	w.done.Add(2)
+	go w.gatherLoop()
+	go w.sendLoop()
+}
+
+func (w *pushWriter) gatherLoop() {
+	defer w.done.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			families, err := w.gather()
+			if err != nil {
+				log.Printf("[ERROR] Gathering metrics to push failed: %v\n", err)
+				continue
+			}
+			w.enqueue(snappy.Encode(nil, encodeWriteRequest(families, w.externalLabels, now)))
+		}
+	}
+}
+
+// enqueue queues the request, dropping the oldest one when the queue is full.
+func (w *pushWriter) enqueue(request []byte) {
+	for {
+		select {
+		case w.queue <- request:
+			return
+		default:
+		}
+		select {
+		case <-w.queue:
+			remoteWriteRequestsTotal.WithLabelValues("dropped").Inc()
+		default:
+		}
+	}
+}
+
+func (w *pushWriter) sendLoop() {
+	defer w.done.Done()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case request := <-w.queue:
+			w.send(request)
+		}
+	}
+}
+
+// send posts the request, retrying with an exponential backoff while the endpoint is
+// unavailable or returns a server error.
+func (w *pushWriter) send(request []byte) {
+	backoff := remoteWriteMinBackoff
+	for attempt := 0; ; attempt++ {
+		retriable, err := w.post(request)
+		if err == nil {
+			remoteWriteRequestsTotal.WithLabelValues("success").Inc()
+			return
+		}
+		if !retriable || attempt >= w.maxRetries {
+			log.Printf("[ERROR] %v\n", err)
+			remoteWriteRequestsTotal.WithLabelValues("failed").Inc()
+			return
+		}
+
+		remoteWriteRequestsTotal.WithLabelValues("retried").Inc()
+		select {
+		case <-w.stop:
+			remoteWriteRequestsTotal.WithLabelValues("failed").Inc()
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+func (w *pushWriter) post(request []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(request))
+	if err != nil {
+		return false, errors.Wrapf(err, "Remote write to %s failed: %v", w.redactedURL, err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "module-metrics")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, errors.Wrapf(err, "Remote write to %s failed: %v", w.redactedURL, err)
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = errors.Errorf("Remote write to %s failed: %s %s", w.redactedURL, resp.Status, bytes.TrimSpace(message))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// encodeWriteRequest encodes the metric families as a remote write prometheus.WriteRequest
+// protobuf. Histograms and summaries are pushed as their classic series.
+func encodeWriteRequest(families []*dto.MetricFamily, externalLabels map[string]string, now time.Time) []byte {
+	var request []byte
+	timestamp := now.UnixMilli()
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			ts := timestamp
+			if metric.TimestampMs != nil {
+				ts = metric.GetTimestampMs()
+			}
+			series := func(suffix string, extra *dto.LabelPair, value float64) {
+				labels := seriesLabels(name+suffix, metric.GetLabel(), extra, externalLabels)
+				request = protowire.AppendTag(request, 1, protowire.BytesType)
+				request = protowire.AppendBytes(request, encodeTimeSeries(labels, value, ts))
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				series("", nil, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				series("", nil, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				series("", nil, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					series("", labelPair(model.QuantileLabel, formatFloat(q.GetQuantile())), q.GetValue())
+				}
+				series("_sum", nil, summary.GetSampleSum())
+				series("_count", nil, float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, b := range histogram.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						continue
+					}
+					series("_bucket", labelPair(model.BucketLabel, formatFloat(b.GetUpperBound())), float64(b.GetCumulativeCount()))
+				}
+				series("_bucket", labelPair(model.BucketLabel, "+Inf"), float64(histogram.GetSampleCount()))
+				series("_sum", nil, histogram.GetSampleSum())
+				series("_count", nil, float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+
+	return request
+}
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// seriesLabels returns the labels of a series sorted by name, as remote write requires. The
+// external labels don't override the labels of the metric.
+func seriesLabels(name string, pairs []*dto.LabelPair, extra *dto.LabelPair, externalLabels map[string]string) [][2]string {
+	labels := [][2]string{{model.MetricNameLabel, name}}
+	seen := map[string]bool{}
+	for _, pair := range pairs {
+		labels = append(labels, [2]string{pair.GetName(), pair.GetValue()})
+		seen[pair.GetName()] = true
+	}
+	if extra != nil {
+		labels = append(labels, [2]string{extra.GetName(), extra.GetValue()})
+		seen[extra.GetName()] = true
+	}
+	for labelName, value := range externalLabels {
+		if !seen[labelName] {
+			labels = append(labels, [2]string{labelName, value})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	return labels
+}
+
+// encodeTimeSeries encodes a prometheus.TimeSeries with a single sample.
+func encodeTimeSeries(labels [][2]string, value float64, timestamp int64) []byte {
+	var series []byte
+	for _, label := range labels {
+		var pair []byte
+		pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+		pair = protowire.AppendString(pair, label[0])
+		pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+		pair = protowire.AppendString(pair, label[1])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, pair)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	return series
+}
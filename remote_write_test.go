@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type sample struct {
+	labels    string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the series of a WriteRequest, their labels formatted like
+// `__name__="x",a="b"`.
+func decodeWriteRequest(t *testing.T, request []byte) []sample {
+	var samples []sample
+	fields(t, request, func(num protowire.Number, series []byte) {
+		var labels []string
+		s := sample{}
+		fields(t, series, func(num protowire.Number, field []byte) {
+			switch num {
+			case 1:
+				var pair [2]string
+				fields(t, field, func(num protowire.Number, value []byte) { pair[num-1] = string(value) })
+				labels = append(labels, pair[0]+`="`+pair[1]+`"`)
+			case 2:
+				fields(t, field, func(num protowire.Number, value []byte) {
+					if num == 1 {
+						bits, _ := protowire.ConsumeFixed64(value)
+						s.value = math.Float64frombits(bits)
+					} else {
+						ts, _ := protowire.ConsumeVarint(value)
+						s.timestamp = int64(ts)
+					}
+				})
+			}
+		})
+		s.labels = strings.Join(labels, ",")
+		samples = append(samples, s)
+	})
+	return samples
+}
+
+// fields calls f with each field of the message, the bytes of a fixed64 or varint field
+// are left encoded.
+func fields(t *testing.T, message []byte, f func(num protowire.Number, value []byte)) {
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		assert.True(t, n > 0)
+		message = message[n:]
+		switch typ {
+		case protowire.BytesType:
+			value, n := protowire.ConsumeBytes(message)
+			f(num, value)
+			message = message[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, message)
+			f(num, message[:n])
+			message = message[n:]
+		}
+		assert.True(t, n > 0)
+	}
+}
+
+// fakeReceiver is a remote write endpoint returning the statuses in order, then 204.
+type fakeReceiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	requests [][]sample
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	compressed, _ := io.ReadAll(req.Body)
+	request, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, decodeWriteRequest(f.t, request))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeReceiver) received() [][]sample {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]sample{}, f.requests...)
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	r := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "h"}, []string{"status", "region"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds", Help: "h", Buckets: []float64{0.1, 1}})
+	r.MustRegister(counter, histogram)
+	counter.WithLabelValues("200", "us").Add(3)
+	histogram.Observe(0.5)
+
+	families, err := r.Gather()
+	assert.NoError(t, err)
+	now := time.UnixMilli(1700000000123)
+	samples := decodeWriteRequest(t, encodeWriteRequest(families, map[string]string{"region": "eu", "node": "edge-1"}, now))
+
+	ts := now.UnixMilli()
+	assert.Equal(t, []sample{
+		{`__name__="duration_seconds_bucket",le="0.1",node="edge-1",region="eu"`, 0, ts},
+		{`__name__="duration_seconds_bucket",le="1",node="edge-1",region="eu"`, 1, ts},
+		{`__name__="duration_seconds_bucket",le="+Inf",node="edge-1",region="eu"`, 1, ts},
+		{`__name__="duration_seconds_sum",node="edge-1",region="eu"`, 0.5, ts},
+		{`__name__="duration_seconds_count",node="edge-1",region="eu"`, 1, ts},
+		// the label of the metric wins over the external label
+		{`__name__="requests_total",node="edge-1",region="us",status="200"`, 3, ts},
+	}, samples)
+}
+
+func TestParseExternalLabels(t *testing.T) {
+	labels, err := parseExternalLabels(" region=eu , node=edge-1,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"region": "eu", "node": "edge-1"}, labels)
+
+	for _, invalid := range []string{"region", "1region=eu", "__name__=x", "a-b=c"} {
+		_, err = parseExternalLabels(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	defer func(backoff time.Duration) { remoteWriteMinBackoff = backoff }(remoteWriteMinBackoff)
+	remoteWriteMinBackoff = time.Millisecond
+	defer func() { serverDisabled = false }()
+	DisableServer()
+	InitMetrics()
+	addRequest(map[string]string{aeeHealthcheckLabel: "false"}, map[string]string{})
+
+	receiver := &fakeReceiver{t: t, statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	for name, value := range map[string]string{
+		"MODULE_METRICS_REMOTE_WRITE_URL":             server.URL + "/api/v1/write",
+		"MODULE_METRICS_REMOTE_WRITE_INTERVAL":        "10ms",
+		"MODULE_METRICS_REMOTE_WRITE_EXTERNAL_LABELS": "node=edge-1",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	assert.NoError(t, StartRemoteWrite())
+	defer StopRemoteWrite()
+
+	assert.Eventually(t, func() bool { return len(receiver.received()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	StopRemoteWrite()
+
+	assert.Contains(t, receiver.received()[0], sample{
+		labels:    `__name__="section_http_request_count_total",node="edge-1",section_aee_healthcheck="false"`,
+		value:     1,
+		timestamp: receiver.received()[0][0].timestamp,
+	})
+	assert.Equal(t, 2.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("retried")))
+	assert.LessOrEqual(t, 1.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("success")))
+	assert.Equal(t, 0.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("failed")))
+}
+
+func TestRemoteWriteFailures(t *testing.T) {
+	defer func(backoff time.Duration) { remoteWriteMinBackoff = backoff }(remoteWriteMinBackoff)
+	remoteWriteMinBackoff = time.Millisecond
+	InitMetrics()
+
+	receiver := &fakeReceiver{t: t, statuses: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusTooManyRequests}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	w := &pushWriter{url: server.URL, redactedURL: server.URL, maxRetries: 1, client: http.DefaultClient,
+		queue: make(chan []byte, 2), stop: make(chan struct{})}
+
+	// a client error isn't retried
+	w.send(snappy.Encode(nil, nil))
+	assert.Equal(t, 1.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("failed")))
+	assert.Equal(t, 0.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("retried")))
+
+	// giving up after the retries
+	w.send(snappy.Encode(nil, nil))
+	assert.Equal(t, 2.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("failed")))
+	assert.Equal(t, 1.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("retried")))
+
+	// the oldest request is dropped once the queue is full
+	for _, request := range []string{"1", "2", "3"} {
+		w.enqueue([]byte(request))
+	}
+	assert.Equal(t, 1.0, counterValue(t, remoteWriteRequestsTotal.WithLabelValues("dropped")))
+	assert.Equal(t, []byte("2"), <-w.queue)
+	assert.Equal(t, []byte("3"), <-w.queue)
+
+	os.Setenv("MODULE_METRICS_REMOTE_WRITE_URL", "localhost:9090")
+	defer os.Unsetenv("MODULE_METRICS_REMOTE_WRITE_URL")
+	assert.Error(t, StartRemoteWrite())
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	assert.NoError(t, counter.Write(&m))
+	return m.GetCounter().GetValue()
+}
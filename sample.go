@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"math/rand"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	passthroughForwarded    = "forwarded"
+	passthroughSampledOut   = "sampled_out"
+	passthroughUnredactable = "unredactable"
+)
+
+// LineFilter reports whether a log line matches, given its labels and derived fields
+// (see EnableLogEnrichment). Lines that could not be parsed have no fields.
+type LineFilter func(fields map[string]string) bool
+
+// FieldEquals returns a LineFilter matching lines where the field has any of the values.
+func FieldEquals(field string, values ...string) LineFilter {
+	return func(fields map[string]string) bool {
+		value, ok := fields[field]
+		return ok && slices.Contains(values, value)
+	}
+}
+
+// AllOf returns a LineFilter matching lines that match all the filters.
+func AllOf(filters ...LineFilter) LineFilter {
+	return func(fields map[string]string) bool {
+		for _, filter := range filters {
+			if !filter(fields) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// SampleRule forwards Rate (0 to 1) of the log lines matching Filter to the output.
+type SampleRule struct {
+	Filter LineFilter
+	Rate   float64
+}
+
+var sampleRules []SampleRule
+
+// SetSampling sets the rules used to sample the log lines written to the output. The first rule
+// matching a line decides its sample rate, lines matching no rule are always forwarded. The metrics
+// still count every line. Calling it with no rules forwards every line.
+func SetSampling(rules ...SampleRule) {
+	sampleRules = rules
+}
+
+// isSampledIn reports whether the line should be forwarded to the output, counting the lines
+// that are sampled out.
+func isSampledIn(fields map[string]string) bool {
+	if sampleRate(fields) > rand.Float64() {
+		return true
+	}
+	passthroughLinesTotal.WithLabelValues(passthroughSampledOut).Inc()
+	return false
+}
+
+func sampleRate(fields map[string]string) float64 {
+	for _, rule := range sampleRules {
+		if rule.Filter != nil && rule.Filter(fields) {
+			return rule.Rate
+		}
+	}
+	return 1
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldEquals(t *testing.T) {
+	isError := FieldEquals(statusClassField, "4xx", "5xx")
+
+	assert.True(t, isError(map[string]string{statusClassField: "5xx"}))
+	assert.True(t, isError(map[string]string{statusClassField: "4xx"}))
+	assert.False(t, isError(map[string]string{statusClassField: "2xx"}))
+	assert.False(t, isError(map[string]string{}))
+	assert.False(t, isError(nil))
+	assert.False(t, FieldEquals(statusClassField, "")(nil))
+}
+
+func TestAllOf(t *testing.T) {
+	healthcheckOK := AllOf(FieldEquals(statusClassField, "2xx"), FieldEquals(uaClassField, uaClassHealthcheck))
+
+	assert.True(t, healthcheckOK(map[string]string{statusClassField: "2xx", uaClassField: uaClassHealthcheck}))
+	assert.False(t, healthcheckOK(map[string]string{statusClassField: "5xx", uaClassField: uaClassHealthcheck}))
+	assert.False(t, healthcheckOK(map[string]string{statusClassField: "2xx", uaClassField: uaClassBrowser}))
+	assert.True(t, AllOf()(nil))
+}
+
+func TestSampleRate(t *testing.T) {
+	SetSampling(
+		SampleRule{Filter: FieldEquals(statusClassField, "5xx"), Rate: 1},
+		SampleRule{Filter: FieldEquals(uaClassField, uaClassHealthcheck), Rate: 0.01},
+		SampleRule{Rate: 0},
+	)
+	defer SetSampling()
+
+	// first matching rule wins
+	assert.Equal(t, float64(1), sampleRate(map[string]string{statusClassField: "5xx", uaClassField: uaClassHealthcheck}))
+	assert.Equal(t, 0.01, sampleRate(map[string]string{statusClassField: "2xx", uaClassField: uaClassHealthcheck}))
+	// rules without a filter are ignored
+	assert.Equal(t, float64(1), sampleRate(map[string]string{statusClassField: "2xx"}))
+}
+
+func TestIsSampledIn(t *testing.T) {
+	InitMetrics()
+
+	SetSampling(
+		SampleRule{Filter: FieldEquals(statusClassField, "2xx"), Rate: 0},
+		SampleRule{Filter: FieldEquals(statusClassField, "3xx"), Rate: 0.5},
+	)
+	defer SetSampling()
+
+	assert.False(t, isSampledIn(map[string]string{statusClassField: "2xx"}))
+	assert.True(t, isSampledIn(map[string]string{statusClassField: "5xx"}))
+	assert.True(t, isSampledIn(nil))
+
+	sampledIn := 0
+	for i := 0; i < 10000; i++ {
+		if isSampledIn(map[string]string{statusClassField: "3xx"}) {
+			sampledIn++
+		}
+	}
+	assert.InDelta(t, 5000, sampledIn, 500)
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_passthrough_lines_total{result="sampled_out"} `+fmt.Sprint(10000-sampledIn+1))
+}
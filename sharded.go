@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// shardedCounterVec is a CounterVec split into a shard per worker so the workers don't contend
+// on the same counters. The shards are summed into a single series per label values on scrape.
+type shardedCounterVec struct {
+	labels []string
+	desc   *prometheus.Desc
+	shards []*prometheus.CounterVec
+}
+
+// newShardedCounterVec creates a shardedCounterVec with a shard for each of the workers.
+func newShardedCounterVec(opts prometheus.CounterOpts, labels []string) *shardedCounterVec {
+	v := &shardedCounterVec{labels: labels}
+	for i := 0; i < workers; i++ {
+		shard := prometheus.NewCounterVec(opts, labels)
+		if len(labels) == 0 {
+			// export 0 before the first increment, like a Counter
+			shard.WithLabelValues()
+		}
+		v.shards = append(v.shards, shard)
+	}
+	descs := make(chan *prometheus.Desc, 1)
+	v.shards[0].Describe(descs)
+	v.desc = <-descs
+	return v
+}
+
+// shard returns the CounterVec updated by the worker.
+func (v *shardedCounterVec) shard(worker int) *prometheus.CounterVec {
+	return v.shards[worker%len(v.shards)]
+}
+
+// Describe implements prometheus.Collector.
+func (v *shardedCounterVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+// Collect implements prometheus.Collector, summing the shards.
+func (v *shardedCounterVec) Collect(ch chan<- prometheus.Metric) {
+	if len(v.shards) == 1 {
+		v.shards[0].Collect(ch)
+		return
+	}
+
+	type series struct {
+		labelValues []string
+		value       float64
+		exemplar    *dto.Exemplar
+	}
+	merged := map[string]*series{}
+	var order []string
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		for _, shard := range v.shards {
+			shard.Collect(metrics)
+		}
+		close(metrics)
+	}()
+
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		labelValues := make([]string, len(v.labels))
+		for _, pair := range m.GetLabel() {
+			for i, label := range v.labels {
+				if label == pair.GetName() {
+					labelValues[i] = pair.GetValue()
+				}
+			}
+		}
+		key := strings.Join(labelValues, "\xff")
+		s, ok := merged[key]
+		if !ok {
+			s = &series{labelValues: labelValues}
+			merged[key] = s
+			order = append(order, key)
+		}
+		s.value += m.GetCounter().GetValue()
+		// keep the latest exemplar of the shards
+		if e := m.GetCounter().GetExemplar(); e != nil && (s.exemplar == nil || s.exemplar.GetTimestamp().AsTime().Before(e.GetTimestamp().AsTime())) {
+			s.exemplar = e
+		}
+	}
+
+	for _, key := range order {
+		s := merged[key]
+		metric := prometheus.MustNewConstMetric(v.desc, prometheus.CounterValue, s.value, s.labelValues...)
+		if s.exemplar != nil {
+			exemplar := prometheus.Exemplar{
+				Value:     s.exemplar.GetValue(),
+				Labels:    prometheus.Labels{},
+				Timestamp: s.exemplar.GetTimestamp().AsTime(),
+			}
+			for _, pair := range s.exemplar.GetLabel() {
+				exemplar.Labels[pair.GetName()] = pair.GetValue()
+			}
+			if withExemplar, err := prometheus.NewMetricWithExemplars(metric, exemplar); err == nil {
+				metric = withExemplar
+			}
+		}
+		ch <- metric
+	}
+}
@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// defaultSinkBufferBytes is the size of the buffer of a Sink without a BufferBytes.
+const defaultSinkBufferBytes = 1024 * 1024
+
+// Sink is an additional output for the log lines, eg a local file for debugging.
+type Sink struct {
+	// Name identifies the sink in error messages.
+	Name   string
+	Writer io.Writer
+	// Filter selects the lines written to the sink, all lines are written if nil.
+	Filter LineFilter
+	// BufferBytes is the size of the buffer the lines are written to the Writer from, 1MiB by
+	// default. Lines are dropped while it is full, so a slow sink doesn't hold up the output.
+	BufferBytes int
+}
+
+var (
+	sinks []Sink
+	// the buffers of the sinks, in the same order
+	sinkWriters []*AsyncWriter
+)
+
+// SetSinks sets the outputs the log lines are written to in addition to the output given to
+// StartReader. Sinks get the same lines as the output, after sampling, redaction and enrichment.
+// Each sink is written to from its own goroutine, a failing sink does not stop the reader, the
+// error is logged instead. Calling it again waits for the lines buffered for the previous sinks
+// to be written, calling it with no sinks removes them.
+func SetSinks(s ...Sink) {
+	writers := make([]*AsyncWriter, len(s))
+	for i, sink := range s {
+		bufferBytes := sink.BufferBytes
+		if bufferBytes <= 0 {
+			bufferBytes = defaultSinkBufferBytes
+		}
+		name := sink.Name
+		writers[i] = newAsyncWriter(sink.Writer, bufferBytes, OverflowDropNewest, func(err error) {
+			log.Printf("[WARN] Writing to sink %s failed: %v\n", name, err)
+		})
+	}
+
+	outputMu.Lock()
+	previous := sinkWriters
+	sinks = s
+	sinkWriters = writers
+	outputMu.Unlock()
+
+	for _, w := range previous {
+		_ = w.Close()
+	}
+}
+
+// writeSinks queues the line for the sinks it passes the filter of, called with outputMu held.
+func writeSinks(line []byte, fields map[string]string) {
+	for i, sink := range sinks {
+		if sink.Filter != nil && !sink.Filter(fields) {
+			continue
+		}
+		_, _ = sinkWriters[i].Write(line)
+	}
+}
+
+// DialSyslog connects to a syslog server, eg network "udp" or "tcp" and address "localhost:514"
+// or network "unixgram" and address "/dev/log", for use as a Sink. Each line is sent as a message
+// with the tag at informational severity.
+func DialSyslog(network string, address string, tag string) (io.WriteCloser, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DialSyslog %s %s failed: %v", network, address, err)
+	}
+	return writer, nil
+}
+
+// RotatingFile is a Sink writer that appends to a local file, renaming it to path.1, path.2, etc
+// once it reaches its maximum size and keeping at most maxBackups of them.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingFile opens the file at path for appending.
+func NewRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past its maximum size.
+// When a rotation fails the file is reopened at path and the rotation is retried on the next write.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Open %s failed: %v", r.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "Stat %s failed: %v", r.path, err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return errors.Wrapf(err, "Close %s failed: %v", r.path, err)
+	}
+
+	if err := r.moveBackups(); err != nil {
+		// keep writing to the current file, a failed open is retried by the next Write
+		_ = r.open()
+		return err
+	}
+	return r.open()
+}
+
+// moveBackups renames the file to path.1, shifting the older backups along, or removes it
+// when no backups are kept.
+func (r *RotatingFile) moveBackups() error {
+	if r.maxBackups < 1 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Remove %s failed: %v", r.path, err)
+		}
+		return nil
+	}
+
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(r.backupPath(i), r.backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Rename %s failed: %v", r.backupPath(i), err)
+		}
+	}
+	if err := os.Rename(r.path, r.backupPath(1)); err != nil {
+		return errors.Wrapf(err, "Rename %s failed: %v", r.path, err)
+	}
+	return nil
+}
+
+func (r *RotatingFile) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
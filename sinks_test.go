@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteSinks(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var all, errorsOnly bytes.Buffer
+	SetSinks(
+		Sink{Name: "all", Writer: &all},
+		Sink{Name: "errors", Writer: &errorsOnly, Filter: FieldEquals(statusClassField, "4xx", "5xx")},
+		Sink{Name: "broken", Writer: failingWriter{}},
+	)
+
+	writeSinks([]byte("ok\n"), map[string]string{statusClassField: "2xx"})
+	writeSinks([]byte("error\n"), map[string]string{statusClassField: "5xx"})
+	writeSinks([]byte("not json\n"), nil)
+	// writes out the buffered lines
+	SetSinks()
+
+	assert.Equal(t, "ok\nerror\nnot json\n", all.String())
+	assert.Equal(t, "error\n", errorsOnly.String())
+	assert.Equal(t, 3, strings.Count(logs.String(), "[WARN] Writing to sink broken failed: disk full\n"))
+}
+
+func TestStalledSinkDoesNotHoldOutput(t *testing.T) {
+	InitMetrics()
+	stalled := newGatedWriter()
+	SetSinks(Sink{Name: "stalled", Writer: stalled, BufferBytes: 8})
+	defer SetSinks()
+
+	var stdout bytes.Buffer
+	r := &reader{source: defaultSource, parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+	r.processLine([]byte(`{"status":200}` + "\n"))
+	r.processLine([]byte(`{"status":404}` + "\n"))
+	r.processLine([]byte(`{"status":500}` + "\n"))
+
+	assert.Equal(t, `{"status":200}`+"\n"+`{"status":404}`+"\n"+`{"status":500}`+"\n", stdout.String())
+
+	close(stalled.gate)
+	SetSinks()
+	// the line being written and the one buffered behind it fill the sink, the last is dropped
+	assert.Contains(t, stalled.String(), `{"status":200}`)
+	assert.NotContains(t, stalled.String(), `{"status":500}`)
+	assert.NotContains(t, gatherP8sResponse(t), `section_http_passthrough_dropped_bytes_total 0`)
+}
+
+func TestRotatingFile(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+
+	r, err := NewRotatingFile(logPath, 10, 2)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		n, err := r.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.NoError(t, r.Close())
+
+	assertFile := func(name string, expected string) {
+		content, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+	assertFile(logPath, "line-4\n")
+	assertFile(logPath+".1", "line-3\n")
+	assertFile(logPath+".2", "line-2\n")
+	_, err = os.Stat(logPath + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// reopening appends to the existing file
+	r, err = NewRotatingFile(logPath, 100, 2)
+	assert.NoError(t, err)
+	_, _ = r.Write([]byte("line-5\n"))
+	assert.NoError(t, r.Close())
+	assertFile(logPath, "line-4\nline-5\n")
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+
+	r, err := NewRotatingFile(logPath, 10, 0)
+	assert.NoError(t, err)
+	_, _ = r.Write([]byte("line-1\n"))
+	_, _ = r.Write([]byte("line-2\n"))
+	assert.NoError(t, r.Close())
+
+	content, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "line-2\n", string(content))
+	_, err = os.Stat(logPath + ".1")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFileRetriesRotation(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+	assert.NoError(t, os.WriteFile(logPath+".1", []byte("line-0\n"), 0644))
+	// a backup can't be renamed over a directory
+	assert.NoError(t, os.MkdirAll(path.Join(logPath+".2", "blocked"), 0755))
+
+	r, err := NewRotatingFile(logPath, 10, 2)
+	assert.NoError(t, err)
+	_, err = r.Write([]byte("line-1\n"))
+	assert.NoError(t, err)
+	_, err = r.Write([]byte("line-2\n"))
+	assert.Error(t, err)
+
+	assert.NoError(t, os.RemoveAll(logPath+".2"))
+	_, err = r.Write([]byte("line-3\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+
+	for suffix, expected := range map[string]string{"": "line-3\n", ".1": "line-1\n", ".2": "line-0\n"} {
+		content, err := os.ReadFile(logPath + suffix)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+}
+
+func TestRotatingFileFails(t *testing.T) {
+	_, err := NewRotatingFile("/i/dont/exist/access.log", 10, 1)
+	assert.Error(t, err)
+}
+
+func TestDialSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	writer, err := DialSyslog("udp", conn.LocalAddr().String(), "module-metrics")
+	assert.NoError(t, err)
+	defer func() { _ = writer.Close() }()
+
+	_, err = writer.Write([]byte(`{"status":"500"}` + "\n"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+
+	message := string(buf[:n])
+	// LOG_LOCAL0|LOG_INFO
+	assert.True(t, strings.HasPrefix(message, "<134>"), message)
+	assert.Contains(t, message, `module-metrics[`)
+	assert.True(t, strings.HasSuffix(message, `{"status":"500"}`+"\n"), message)
+}
+
+func TestDialSyslogFails(t *testing.T) {
+	_, err := DialSyslog("unixgram", "/i/dont/exist.sock", "module-metrics")
+	assert.Error(t, err)
+}
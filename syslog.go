@@ -0,0 +1,446 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	syslogMaxMessageBytes = 64 * 1024
+	syslogQueueLength     = 1024
+)
+
+var (
+	// the syslog listeners started by SetupInputs, closed when the inputs are set up again
+	syslogListenersMu sync.Mutex
+	syslogListeners   []*syslogListener
+)
+
+// syslogListener receives syslog messages for one or more inputs sharing the same network
+// address, the tag of each message picks the input that processes it.
+type syslogListener struct {
+	network     string
+	address     string
+	listener    net.Listener
+	conn        net.PacketConn
+	routes      map[string]*reader
+	messages    chan []byte
+	errorWriter io.Writer
+
+	// the accepted stream connections, closed with the listener
+	mu         sync.Mutex
+	conns      map[net.Conn]struct{}
+	closed     chan struct{}
+	closedOnce sync.Once
+}
+
+// listenSyslog opens the socket, removing a stale unix socket file first.
+func listenSyslog(network string, address string, errorWriter io.Writer) (*syslogListener, error) {
+	l := &syslogListener{
+		network:     network,
+		address:     address,
+		routes:      map[string]*reader{},
+		messages:    make(chan []byte, syslogQueueLength),
+		errorWriter: errorWriter,
+		conns:       map[net.Conn]struct{}{},
+		closed:      make(chan struct{}),
+	}
+
+	if network == "unix" || network == "unixgram" {
+		err := os.Remove(address)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Remove %s failed: %v", address, err)
+		}
+	}
+
+	var err error
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		l.conn, err = net.ListenPacket(network, address)
+	case "tcp", "tcp4", "tcp6", "unix":
+		l.listener, err = net.Listen(network, address)
+	default:
+		return nil, errors.Errorf("syslog network %s is not supported", network)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Listen %s %s failed: %v", network, address, err)
+	}
+
+	if network == "unix" || network == "unixgram" {
+		// Make sure other users, eg the nginx workers, can write to the socket
+		err = os.Chmod(address, 0666)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Chmod %s failed: %v", address, err)
+		}
+	}
+
+	return l, nil
+}
+
+// route sends the messages with the tag to the reader, an empty tag matches the messages
+// that don't match any other route.
+func (l *syslogListener) route(tag string, r *reader) {
+	l.routes[tag] = r
+}
+
+// start receives the messages in the background, processing them on a single goroutine.
+func (l *syslogListener) start() {
+	for _, r := range l.routes {
+		trackReader(r)
+		r.state.Store(readerOpen)
+	}
+
+	go func() {
+		for {
+			select {
+			case message := <-l.messages:
+				l.processMessage(message)
+			case <-l.closed:
+				for _, r := range l.routes {
+					r.stopDispatching()
+					r.state.Store(readerStopped)
+				}
+				return
+			}
+		}
+	}()
+
+	if l.conn != nil {
+		go l.receivePackets()
+		return
+	}
+	go l.accept()
+}
+
+// close closes the socket and the accepted connections, the receiving goroutines stop and
+// the messages not processed yet are dropped.
+func (l *syslogListener) close() {
+	l.closedOnce.Do(func() { close(l.closed) })
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+	if l.listener != nil {
+		_ = l.listener.Close()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+}
+
+// send queues the message for processing unless the listener has been closed.
+func (l *syslogListener) send(message []byte) {
+	select {
+	case l.messages <- message:
+	case <-l.closed:
+	}
+}
+
+// trackSyslogListener adds the listener to the ones closed by closeSyslogListeners.
+func trackSyslogListener(l *syslogListener) {
+	syslogListenersMu.Lock()
+	defer syslogListenersMu.Unlock()
+	syslogListeners = append(syslogListeners, l)
+}
+
+// closeSyslogListeners closes the listeners started so far, freeing their addresses.
+func closeSyslogListeners() {
+	syslogListenersMu.Lock()
+	defer syslogListenersMu.Unlock()
+	for _, l := range syslogListeners {
+		l.close()
+	}
+	syslogListeners = nil
+}
+
+func (l *syslogListener) processMessage(message []byte) {
+	tag, payload := parseSyslog(message)
+	r, ok := l.routes[tag]
+	if !ok {
+		r, ok = l.routes[""]
+	}
+	if !ok {
+		_, _ = fmt.Fprintf(l.errorWriter, "No syslog input for tag %q\n", tag)
+		return
+	}
+
+	line := make([]byte, 0, len(payload)+1)
+	line = append(line, bytes.TrimRight(payload, "\r\n")...)
+	r.lineRead(len(message))
+	r.dispatch(append(line, '\n'), false, nil)
+}
+
+// oversized counts a message longer than syslogMaxMessageBytes for the input its tag routes
+// it to, the message has been dropped.
+func (l *syslogListener) oversized(start []byte) {
+	tag, _ := parseSyslog(start)
+	r, ok := l.routes[tag]
+	if !ok {
+		r, ok = l.routes[""]
+	}
+	if ok {
+		oversizedLinesTotal.WithLabelValues(r.source).Inc()
+	}
+	_, _ = fmt.Fprintf(l.errorWriter, "Dropped a syslog message on %s longer than %d bytes\n", l.address, syslogMaxMessageBytes)
+}
+
+// receivePackets receives the datagrams until the socket is closed, backing off while
+// receiving fails.
+func (l *syslogListener) receivePackets() {
+	buffer := make([]byte, syslogMaxMessageBytes)
+	backoff := fifoReopenMinBackoff
+	for {
+		n, _, err := l.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			_, _ = fmt.Fprintf(l.errorWriter, "ReadFrom %s failed: %v\n", l.address, err)
+			backoff = sleepBackoff(backoff)
+			continue
+		}
+		backoff = fifoReopenMinBackoff
+		message := make([]byte, n)
+		copy(message, buffer[:n])
+		l.send(message)
+	}
+}
+
+// accept receives the messages of each connection until the listener is closed, backing
+// off while accepting fails, eg when out of file descriptors.
+func (l *syslogListener) accept() {
+	backoff := fifoReopenMinBackoff
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			_, _ = fmt.Fprintf(l.errorWriter, "Accept %s failed: %v\n", l.address, err)
+			backoff = sleepBackoff(backoff)
+			continue
+		}
+		backoff = fifoReopenMinBackoff
+
+		l.mu.Lock()
+		select {
+		case <-l.closed:
+			l.mu.Unlock()
+			_ = conn.Close()
+			return
+		default:
+		}
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		go l.receiveStream(conn)
+	}
+}
+
+// receiveStream reads the messages from a stream connection, until the sender or the
+// listener closes it.
+func (l *syslogListener) receiveStream(conn net.Conn) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	frameReader := bufio.NewReader(conn)
+	for {
+		message, err := readSyslogFrame(frameReader)
+		if len(message) > 0 {
+			l.send(message)
+		}
+		var oversized *syslogOversizedError
+		if errors.As(err, &oversized) {
+			l.oversized(oversized.start)
+			continue
+		}
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(l.errorWriter, "Reading syslog from %s failed: %v\n", l.address, err)
+			return
+		}
+	}
+}
+
+// syslogOversizedError is returned for a message longer than syslogMaxMessageBytes, it has
+// been skipped and the next message can be read.
+type syslogOversizedError struct {
+	// the first syslogMaxMessageBytes of the message
+	start []byte
+}
+
+func (e *syslogOversizedError) Error() string {
+	return fmt.Sprintf("syslog message longer than %d bytes", syslogMaxMessageBytes)
+}
+
+// readSyslogFrame reads a single message from a stream, either octet counted ("<length> <message>")
+// or terminated by a newline, see RFC 6587.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] < '0' || first[0] > '9' {
+		return readSyslogLine(r)
+	}
+
+	lengthStr, err := r.ReadString(' ')
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading syslog frame length failed")
+	}
+	length, err := strconv.ParseInt(lengthStr[:len(lengthStr)-1], 10, 64)
+	if err != nil || length < 0 {
+		return nil, errors.Errorf("invalid syslog frame length %s", lengthStr)
+	}
+
+	size := length
+	if size > syslogMaxMessageBytes {
+		size = syslogMaxMessageBytes
+	}
+	message := make([]byte, size)
+	_, err = io.ReadFull(r, message)
+	if err == nil && length > size {
+		_, err = io.CopyN(io.Discard, r, length-size)
+		if err == nil {
+			return nil, &syslogOversizedError{start: message}
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading syslog frame failed")
+	}
+	return message, nil
+}
+
+// readSyslogLine reads a message terminated by a newline, without buffering more than
+// syslogMaxMessageBytes of it.
+func readSyslogLine(r *bufio.Reader) ([]byte, error) {
+	var message []byte
+	oversized := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !oversized && len(message)+len(chunk) > syslogMaxMessageBytes {
+			oversized = true
+			chunk = chunk[:syslogMaxMessageBytes-len(message)]
+		}
+		if !oversized || len(message) < syslogMaxMessageBytes {
+			message = append(message, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case oversized && (err == nil || err == io.EOF):
+			return nil, &syslogOversizedError{start: message}
+		}
+		return message, err
+	}
+}
+
+// parseSyslog strips the RFC 5424 or RFC 3164 envelope of the message, returning its tag
+// (APP-NAME) and payload. A message without an envelope is returned as is.
+func parseSyslog(message []byte) (string, []byte) {
+	if len(message) < 3 || message[0] != '<' {
+		return "", message
+	}
+	end := bytes.IndexByte(message, '>')
+	if end < 2 || end > 4 {
+		return "", message
+	}
+	if _, err := strconv.Atoi(string(message[1:end])); err != nil {
+		return "", message
+	}
+	rest := message[end+1:]
+
+	if len(rest) > 1 && rest[0] == '1' && rest[1] == ' ' {
+		return parseRFC5424(rest[2:])
+	}
+	return parseRFC3164(rest)
+}
+
+// parseRFC5424 parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG".
+func parseRFC5424(rest []byte) (string, []byte) {
+	var fields [5][]byte
+	for i := range fields {
+		fields[i], rest = nextSyslogToken(rest)
+	}
+	tag := string(fields[2])
+	if tag == "-" {
+		tag = ""
+	}
+
+	rest = skipStructuredData(rest)
+	if len(rest) > 0 && rest[0] == ' ' {
+		rest = rest[1:]
+	}
+	return tag, bytes.TrimPrefix(rest, []byte("\xEF\xBB\xBF"))
+}
+
+// skipStructuredData skips "-" or a sequence of "[id param="value"]" elements.
+func skipStructuredData(rest []byte) []byte {
+	if len(rest) > 0 && rest[0] == '-' {
+		return rest[1:]
+	}
+
+	inQuotes := false
+	for i := 0; i < len(rest); i++ {
+		switch {
+		case inQuotes && rest[i] == '\\':
+			i++
+		case rest[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && rest[i] == ']' && (i+1 == len(rest) || rest[i+1] != '['):
+			return rest[i+1:]
+		}
+	}
+	return nil
+}
+
+// parseRFC3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG", the hostname is optional as
+// it's left out by senders writing to a local socket.
+func parseRFC3164(rest []byte) (string, []byte) {
+	const timestampLength = len("Jan _2 15:04:05 ")
+	if len(rest) >= timestampLength && rest[3] == ' ' && rest[9] == ':' && rest[12] == ':' {
+		rest = rest[timestampLength:]
+	}
+
+	token, remainder := nextSyslogToken(rest)
+	if !isSyslogTag(token) {
+		token, remainder = nextSyslogToken(remainder)
+		if !isSyslogTag(token) {
+			return "", rest
+		}
+	}
+
+	tag := token[:len(token)-1]
+	if i := bytes.IndexByte(tag, '['); i >= 0 {
+		tag = tag[:i]
+	}
+	return string(tag), remainder
+}
+
+func isSyslogTag(token []byte) bool {
+	return len(token) > 1 && token[len(token)-1] == ':'
+}
+
+func nextSyslogToken(rest []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(rest, ' ')
+	if i < 0 {
+		return rest, nil
+	}
+	return rest[:i], rest[i+1:]
+}
@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyslog(t *testing.T) {
+	cases := []struct {
+		message string
+		tag     string
+		payload string
+	}{
+		{`<190>Jun 20 01:34:36 edge-1 nginx: {"status":"200"}`, "nginx", `{"status":"200"}`},
+		{`<190>Jun  2 01:34:36 nginx[42]: {"status":"200"}`, "nginx", `{"status":"200"}`},
+		{`<134>Jun 20 01:34:36 edge-1 haproxy[7]: GET / 200`, "haproxy", `GET / 200`},
+		{`<165>1 2019-06-20T01:34:36.000Z edge-1 nginx 42 access - {"status":"200"}`, "nginx", `{"status":"200"}`},
+		{`<165>1 2019-06-20T01:34:36.000Z edge-1 - - - [id a="x\"]y"][id2 b="z"] message`, "", `message`},
+		{"<165>1 2019-06-20T01:34:36.000Z edge-1 nginx - - - \xEF\xBB\xBFbom", "nginx", `bom`},
+		{`<165>1 2019-06-20T01:34:36.000Z edge-1 nginx - - -`, "nginx", ``},
+		{`{"status":"200"}`, "", `{"status":"200"}`},
+		{`<notapri>message`, "", `<notapri>message`},
+		{`<190>Jun 20 01:34:36 no tag here`, "", `no tag here`},
+	}
+
+	for _, c := range cases {
+		tag, payload := parseSyslog([]byte(c.message))
+		assert.Equal(t, c.tag, tag, c.message)
+		assert.Equal(t, c.payload, string(payload), c.message)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	frameReader := bufio.NewReader(strings.NewReader("11 <1>counted\n<1>newline\n<1>last"))
+
+	message, err := readSyslogFrame(frameReader)
+	assert.NoError(t, err)
+	assert.Equal(t, "<1>counted\n", string(message))
+
+	message, err = readSyslogFrame(frameReader)
+	assert.NoError(t, err)
+	assert.Equal(t, "<1>newline\n", string(message))
+
+	message, err = readSyslogFrame(frameReader)
+	assert.Equal(t, "<1>last", string(message))
+	assert.Equal(t, io.EOF, err)
+
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader("x99 <1>bad length")))
+	assert.Error(t, err)
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader("99999999 <1>too long")))
+	assert.Error(t, err)
+}
+
+func TestReadSyslogFrameOversized(t *testing.T) {
+	long := "<1>app: " + strings.Repeat("x", syslogMaxMessageBytes)
+	frameReader := bufio.NewReader(strings.NewReader(
+		long + "\n" + fmt.Sprintf("%d %s", len(long), long) + "<1>next\n"))
+
+	var oversized *syslogOversizedError
+	_, err := readSyslogFrame(frameReader)
+	assert.ErrorAs(t, err, &oversized)
+	assert.Equal(t, long[:syslogMaxMessageBytes], string(oversized.start))
+
+	_, err = readSyslogFrame(frameReader)
+	assert.ErrorAs(t, err, &oversized)
+	assert.Equal(t, long[:syslogMaxMessageBytes], string(oversized.start))
+
+	message, err := readSyslogFrame(frameReader)
+	assert.NoError(t, err)
+	assert.Equal(t, "<1>next\n", string(message))
+}
+
+func TestSetupInputsSyslog(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+	defer func() { includeSourceLabel = false }()
+
+	socketPath := path.Join(t.TempDir(), "syslog.sock")
+	udpAddress := "127.0.0.1:15514"
+
+	var stdout bytes.Buffer
+	err := SetupInputs(&stdout, os.Stderr,
+		Input{Kind: InputSyslog, Network: "unix", Address: socketPath, Tag: "nginx", Labels: []string{"status"}},
+		Input{Kind: InputSyslog, Network: "unix", Address: socketPath, Source: "other", Labels: []string{"status"}},
+		Input{Kind: InputSyslog, Network: "udp", Address: udpAddress, Source: "udp", Labels: []string{"status"}},
+	)
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("unix", socketPath)
+	assert.NoError(t, err)
+	counted := `<190>Jun 20 01:34:36 edge-1 haproxy: {"status":"404"}`
+	oversized := `<190>Jun 20 01:34:36 edge-1 nginx: ` + strings.Repeat("x", syslogMaxMessageBytes) + "\n"
+	_, err = conn.Write([]byte(oversized + `<190>Jun 20 01:34:36 edge-1 nginx: {"status":"200"}` + "\n" +
+		strconv.Itoa(len(counted)) + " " + counted))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	conn, err = net.Dial("udp", udpAddress)
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte(`<165>1 2019-06-20T01:34:36.000Z edge-1 nginx - - - {"status":"500"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	time.Sleep(50 * time.Millisecond)
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",source="nginx",status="200"} 1`)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",source="other",status="404"} 1`)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",source="udp",status="500"} 1`)
+	assert.Contains(t, actual, `section_http_oversized_lines_total{source="nginx"} 1`)
+
+	outputLines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.ElementsMatch(t, []string{`{"status":"200"}`, `{"status":"404"}`, `{"status":"500"}`}, outputLines)
+}
+
+func TestSetupInputsSyslogTwice(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping test in short mode.")
+	}
+	defer func() { includeSourceLabel = false }()
+	defer closeSyslogListeners()
+
+	socketPath := path.Join(t.TempDir(), "syslog.sock")
+	tcpAddress := "127.0.0.1:15515"
+	inputs := []Input{
+		{Kind: InputSyslog, Network: "tcp", Address: tcpAddress, Source: "tcp", Labels: []string{"status"}},
+		{Kind: InputSyslog, Network: "unix", Address: socketPath, Source: "unix", Labels: []string{"status"}},
+	}
+
+	var first, second bytes.Buffer
+	assert.NoError(t, SetupInputs(&first, io.Discard, inputs...))
+	// a connection to the first listeners is closed with them
+	conn, err := net.Dial("tcp", tcpAddress)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	assert.NoError(t, SetupInputs(&second, io.Discard, inputs...))
+
+	for _, input := range inputs {
+		conn, err := net.Dial(input.Network, input.Address)
+		assert.NoError(t, err)
+		_, err = conn.Write([]byte(`<190>Jun 20 01:34:36 edge-1 nginx: {"status":"200"}` + "\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+	}
+	_, err = conn.Write([]byte(`<190>Jun 20 01:34:36 edge-1 nginx: {"status":"500"}` + "\n"))
+	assert.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",source="tcp",status="200"} 1`)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",source="unix",status="200"} 1`)
+	assert.NotContains(t, actual, `status="500"`)
+	assert.Empty(t, first.String())
+	assert.Equal(t, `{"status":"200"}`+"\n"+`{"status":"200"}`+"\n", second.String())
+}
+
+func TestSetupInputsSyslogFails(t *testing.T) {
+	socketPath := path.Join(t.TempDir(), "syslog.sock")
+
+	err := SetupInputs(os.Stdout, os.Stderr,
+		Input{Kind: InputSyslog, Network: "unix", Address: socketPath, Source: "a"},
+		Input{Kind: InputSyslog, Network: "unix", Address: socketPath, Source: "b"},
+	)
+	assert.EqualError(t, err, `syslog tag "" on unix `+socketPath+` is not unique`)
+
+	err = SetupInputs(os.Stdout, os.Stderr, Input{Kind: InputSyslog, Network: "sctp", Address: socketPath})
+	assert.EqualError(t, err, "syslog network sctp is not supported")
+}
+
+func TestSyslogListenerStopsWhenClosed(t *testing.T) {
+	tcp, err := listenSyslog("tcp", "127.0.0.1:0", io.Discard)
+	assert.NoError(t, err)
+	udp, err := listenSyslog("udp", "127.0.0.1:0", io.Discard)
+	assert.NoError(t, err)
+
+	done := make(chan struct{}, 2)
+	go func() { tcp.accept(); done <- struct{}{} }()
+	go func() { udp.receivePackets(); done <- struct{}{} }()
+	assert.NoError(t, tcp.listener.Close())
+	assert.NoError(t, udp.conn.Close())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the syslog listener to stop")
+		}
+	}
+}
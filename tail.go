@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tailPollInterval  = 250 * time.Millisecond
+	tailStateInterval = time.Second
+)
+
+var (
+	// the tailers started by SetupInputs, closed when the inputs are set up again
+	tailersMu sync.Mutex
+	tailers   []*fileTailer
+)
+
+// tailState is the content of a tail input's state file.
+type tailState struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// fileTailer follows a regular log file, like `tail -F`. It detects rotation by rename when the
+// path refers to a different inode and by truncation when the file shrinks below the read offset.
+// The offset of the processed lines is persisted to the state file so a restart resumes where it
+// left off. Read only returns io.EOF once the tailer is closed.
+type fileTailer struct {
+	path         string
+	stateFile    string
+	pollInterval time.Duration
+	errorWriter  io.Writer
+
+	file    *os.File
+	offset  int64
+	partial bool
+
+	// mu guards the state, the lines are committed once processed which can be after
+	// the tailer has read further, rotated or been closed
+	mu        sync.Mutex
+	inode     uint64
+	committed int64
+	// generation counts the rotations, lines of the previous file committed afterwards are ignored
+	generation int
+	saved      tailState
+	savedAt    time.Time
+
+	closed     chan struct{}
+	closedOnce sync.Once
+}
+
+func inodeOf(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// newFileTailer opens the file at the offset saved in stateFile if it still refers to the
+// same file, at the start if it has been rotated since, or otherwise at the end. The file
+// doesn't need to exist yet.
+func newFileTailer(path string, stateFile string, errorWriter io.Writer) (*fileTailer, error) {
+	t := &fileTailer{
+		path:         path,
+		stateFile:    stateFile,
+		pollInterval: tailPollInterval,
+		errorWriter:  errorWriter,
+		closed:       make(chan struct{}),
+	}
+
+	state, err := t.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Open %s failed: %v", path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "Stat %s failed: %v", path, err)
+	}
+
+	offset := info.Size()
+	if state != nil {
+		offset = 0
+		if state.Inode == inodeOf(info) && state.Offset <= info.Size() {
+			offset = state.Offset
+		}
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "Seek %s failed: %v", path, err)
+	}
+
+	t.file = file
+	t.inode = inodeOf(info)
+	t.offset = offset
+	t.committed = offset
+	return t, nil
+}
+
+func (t *fileTailer) loadState() (*tailState, error) {
+	if t.stateFile == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(t.stateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "ReadFile %s failed: %v", t.stateFile, err)
+	}
+
+	var state tailState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading tail state %s failed: %v", t.stateFile, err)
+	}
+	t.saved = state
+	return &state, nil
+}
+
+// saveState writes the offset of the processed lines to the state file, at most once per
+// tailStateInterval unless forced.
+func (t *fileTailer) saveState(force bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.saveStateLocked(force)
+}
+
+func (t *fileTailer) saveStateLocked(force bool) {
+	state := tailState{Inode: t.inode, Offset: t.committed}
+	if t.stateFile == "" || state == t.saved {
+		return
+	}
+	if !force && time.Since(t.savedAt) < tailStateInterval {
+		return
+	}
+
+	content, _ := json.Marshal(state)
+	tempFile := t.stateFile + ".tmp"
+	err := os.WriteFile(tempFile, content, 0644)
+	if err == nil {
+		err = os.Rename(tempFile, t.stateFile)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(t.errorWriter, "Saving tail state %s failed: %v\n", t.stateFile, err)
+		return
+	}
+	t.saved = state
+	t.savedAt = time.Now()
+}
+
+// commitLater returns a function recording that the line of n bytes just read from the tailer
+// has been processed. Lines processed after the tailer is closed are saved straight away.
+func (t *fileTailer) commitLater(n int) func() {
+	t.mu.Lock()
+	generation := t.generation
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.generation != generation {
+			return
+		}
+		t.committed += int64(n)
+		select {
+		case <-t.closed:
+			t.saveStateLocked(true)
+		default:
+		}
+	}
+}
+
+// rotate checks whether the file at the path has been replaced or truncated, switching to
+// its start if so.
+func (t *fileTailer) rotate() (bool, error) {
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		// renamed but not recreated yet, keep waiting on the old file
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "Stat %s failed: %v", t.path, err)
+	}
+
+	if t.file != nil && inodeOf(info) == t.inode && info.Size() >= t.offset {
+		return false, nil
+	}
+
+	if t.file != nil && inodeOf(info) == t.inode {
+		_, err = t.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, errors.Wrapf(err, "Seek %s failed: %v", t.path, err)
+		}
+	} else {
+		file, err := os.Open(t.path)
+		if err != nil {
+			return false, errors.Wrapf(err, "Open %s failed: %v", t.path, err)
+		}
+		if t.file != nil {
+			_ = t.file.Close()
+		}
+		t.file = file
+	}
+
+	t.offset = 0
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inode = inodeOf(info)
+	t.committed = 0
+	t.generation++
+	t.saveStateLocked(true)
+	return true, nil
+}
+
+// Read reads from the file, polling for more data or a rotation at the end of it.
+func (t *fileTailer) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-t.closed:
+			t.saveState(true)
+			if t.file != nil {
+				_ = t.file.Close()
+				t.file = nil
+			}
+			return 0, io.EOF
+		default:
+		}
+
+		if t.file != nil {
+			n, err := t.file.Read(p)
+			if n > 0 {
+				t.offset += int64(n)
+				t.partial = p[n-1] != '\n'
+				t.saveState(false)
+				return n, nil
+			}
+			if err != nil && err != io.EOF {
+				return 0, errors.Wrapf(err, "Read %s failed: %v", t.path, err)
+			}
+		}
+
+		if t.partial && len(p) > 0 {
+			// the end of the file may be rotated away, so terminate the last line
+			// rather than joining it with the first line of the next file
+			info, err := os.Stat(t.path)
+			if err == nil && (inodeOf(info) != t.inode || info.Size() < t.offset) {
+				p[0] = '\n'
+				t.partial = false
+				return 1, nil
+			}
+		}
+
+		rotated, err := t.rotate()
+		if err != nil {
+			return 0, err
+		}
+		if rotated {
+			continue
+		}
+
+		t.saveState(false)
+		select {
+		case <-t.closed:
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// Close stops the tailer, the pending Read returns io.EOF after saving the state.
+func (t *fileTailer) Close() error {
+	t.closedOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+// trackTailer adds the tailer to the ones closed by closeTailers.
+func trackTailer(t *fileTailer) {
+	tailersMu.Lock()
+	defer tailersMu.Unlock()
+	tailers = append(tailers, t)
+}
+
+// closeTailers stops the tailers started so far, their readers stop once the state is saved.
+func closeTailers() {
+	tailersMu.Lock()
+	defer tailersMu.Unlock()
+	for _, t := range tailers {
+		_ = t.Close()
+	}
+	tailers = nil
+}
@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendToFile(t *testing.T, filePath string, content string) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString(content)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+}
+
+// readTailedLines reads count lines from the tailer, committing each one.
+func readTailedLines(t *testing.T, tailer *fileTailer, lineReader *bufio.Reader, count int) []string {
+	lines := make(chan string)
+	go func() {
+		for i := 0; i < count; i++ {
+			line, err := lineReader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			tailer.commitLater(len(line))()
+			lines <- line
+		}
+	}()
+
+	var result []string
+	for i := 0; i < count; i++ {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return result
+			}
+			result = append(result, line)
+		case <-time.After(2 * time.Second):
+			t.Errorf("Timed out waiting for line %d", i+1)
+			return result
+		}
+	}
+	return result
+}
+
+func newTestTailer(t *testing.T, logPath string, statePath string) (*fileTailer, *bufio.Reader) {
+	tailer, err := newFileTailer(logPath, statePath, os.Stderr)
+	assert.NoError(t, err)
+	tailer.pollInterval = time.Millisecond
+	return tailer, bufio.NewReader(tailer)
+}
+
+func TestFileTailerStartsAtEnd(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+	appendToFile(t, logPath, "before\n")
+
+	tailer, lineReader := newTestTailer(t, logPath, "")
+	defer tailer.Close()
+
+	appendToFile(t, logPath, "after\n")
+	assert.Equal(t, []string{"after\n"}, readTailedLines(t, tailer, lineReader, 1))
+}
+
+func TestFileTailerWaitsForFile(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+
+	tailer, lineReader := newTestTailer(t, logPath, "")
+	defer tailer.Close()
+
+	appendToFile(t, logPath, "first\n")
+	assert.Equal(t, []string{"first\n"}, readTailedLines(t, tailer, lineReader, 1))
+}
+
+func TestFileTailerRename(t *testing.T) {
+	dir := t.TempDir()
+	logPath := path.Join(dir, "access.log")
+	appendToFile(t, logPath, "")
+
+	tailer, lineReader := newTestTailer(t, logPath, "")
+	defer tailer.Close()
+
+	appendToFile(t, logPath, "one\ntwo")
+	assert.Equal(t, []string{"one\n"}, readTailedLines(t, tailer, lineReader, 1))
+
+	assert.NoError(t, os.Rename(logPath, logPath+".1"))
+	appendToFile(t, logPath+".1", " continued\n")
+	appendToFile(t, logPath, "three\n")
+
+	assert.Equal(t, []string{"two continued\n", "three\n"}, readTailedLines(t, tailer, lineReader, 2))
+}
+
+func TestFileTailerTerminatesPartialLineOnRotation(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+	appendToFile(t, logPath, "")
+
+	tailer, lineReader := newTestTailer(t, logPath, "")
+	defer tailer.Close()
+
+	appendToFile(t, logPath, "one\npartial")
+	assert.Equal(t, []string{"one\n"}, readTailedLines(t, tailer, lineReader, 1))
+
+	// give the tailer time to read the partial line before rotating
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, os.Rename(logPath, logPath+".1"))
+	appendToFile(t, logPath, "two\n")
+
+	assert.Equal(t, []string{"partial\n", "two\n"}, readTailedLines(t, tailer, lineReader, 2))
+}
+
+func TestFileTailerTruncate(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "access.log")
+	appendToFile(t, logPath, "")
+
+	tailer, lineReader := newTestTailer(t, logPath, "")
+	defer tailer.Close()
+
+	appendToFile(t, logPath, "a long first line\n")
+	assert.Equal(t, []string{"a long first line\n"}, readTailedLines(t, tailer, lineReader, 1))
+
+	assert.NoError(t, os.Truncate(logPath, 0))
+	appendToFile(t, logPath, "short\n")
+
+	assert.Equal(t, []string{"short\n"}, readTailedLines(t, tailer, lineReader, 1))
+}
+
+func TestFileTailerState(t *testing.T) {
+	dir := t.TempDir()
+	logPath := path.Join(dir, "access.log")
+	statePath := path.Join(dir, "access.state")
+	appendToFile(t, logPath, "")
+
+	tailer, lineReader := newTestTailer(t, logPath, statePath)
+	appendToFile(t, logPath, "one\ntwo\n")
+	assert.Equal(t, []string{"one\n", "two\n"}, readTailedLines(t, tailer, lineReader, 2))
+	assert.NoError(t, tailer.Close())
+	_, _ = lineReader.ReadString('\n') // returns EOF once the state is saved
+
+	appendToFile(t, logPath, "three\n")
+
+	tailer, lineReader = newTestTailer(t, logPath, statePath)
+	defer tailer.Close()
+	assert.Equal(t, []string{"three\n"}, readTailedLines(t, tailer, lineReader, 1))
+
+	// a state file for a rotated file starts the new file from its beginning
+	assert.NoError(t, os.Rename(logPath, logPath+".1"))
+	appendToFile(t, logPath, "four\n")
+
+	tailer, lineReader = newTestTailer(t, logPath, statePath)
+	defer tailer.Close()
+	assert.Equal(t, []string{"four\n"}, readTailedLines(t, tailer, lineReader, 1))
+}
+
+func TestFileTailerInvalidState(t *testing.T) {
+	dir := t.TempDir()
+	statePath := path.Join(dir, "access.state")
+	appendToFile(t, statePath, "not json")
+
+	_, err := newFileTailer(path.Join(dir, "access.log"), statePath, os.Stderr)
+	assert.Error(t, err)
+}
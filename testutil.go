@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"testing"
 	"time"
@@ -29,9 +30,13 @@ func setupReader(t *testing.T) *bytes.Buffer {
 }
 
 func writeLogs(t *testing.T, logs []string) {
-	writer, err := os.OpenFile(fifoFilePath, os.O_RDWR, os.ModeNamedPipe)
+	writeLogsTo(t, fifoFilePath, logs)
+}
+
+func writeLogsTo(t *testing.T, path string, logs []string) {
+	writer, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
 	if err != nil {
-		t.Errorf("OpenFile %s failed: %#v", fifoFilePath, err)
+		t.Errorf("OpenFile %s failed: %#v", path, err)
 	}
 	defer func() { _ = writer.Close() }()
 
@@ -45,3 +50,19 @@ func writeLogs(t *testing.T, logs []string) {
 	//Give the reader loop time to finish
 	time.Sleep(time.Millisecond * 10)
 }
+
+// parseLogLine returns the fields JSONParser extracts from the log line holding fields.
+func parseLogLine(fields map[string]interface{}) map[string]string {
+	if fields == nil {
+		return nil
+	}
+	line, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	logline, err := JSONParser(line)
+	if err != nil {
+		panic(err)
+	}
+	return logline
+}
@@ -0,0 +1,387 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// webConfig is the P8S_WEB_CONFIG_FILE, in the format of the Prometheus exporter-toolkit web
+// config file plus a bearer token.
+type webConfig struct {
+	TLSServerConfig *tlsServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+
+	bearerToken string
+}
+
+type tlsServerConfig struct {
+	CertFile          string   `yaml:"cert_file"`
+	KeyFile           string   `yaml:"key_file"`
+	ClientAuthType    string   `yaml:"client_auth_type"`
+	ClientCAFile      string   `yaml:"client_ca_file"`
+	ClientAllowedSans []string `yaml:"client_allowed_sans"`
+	MinVersion        string   `yaml:"min_version"`
+	MaxVersion        string   `yaml:"max_version"`
+	CipherSuites      []string `yaml:"cipher_suites"`
+	CurvePreferences  []string `yaml:"curve_preferences"`
+}
+
+// webConfigKeys are the keys of the web config file this module implements, by section.
+// Other keys, such as the rest of the exporter-toolkit ones, are ignored with a warning.
+var webConfigKeys = map[string][]string{
+	"": {"tls_server_config", "basic_auth_users", "bearer_token_file"},
+	"tls_server_config": {"cert_file", "key_file", "client_auth_type", "client_ca_file",
+		"client_allowed_sans", "min_version", "max_version", "cipher_suites", "curve_preferences"},
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// loadWebConfig reads and validates the web config file.
+func loadWebConfig(path string) (*webConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading web config %s failed: %v", path, err)
+	}
+
+	config := &webConfig{}
+	err = yaml.NewDecoder(bytes.NewReader(content)).Decode(config)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "Parsing web config %s failed: %v", path, err)
+	}
+	for _, key := range unsupportedWebConfigKeys(content) {
+		log.Printf("[WARN] Web config %s: %s is not supported, ignoring it\n", path, key)
+	}
+
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, errors.Wrapf(err, "Password of basic auth user %s is not a bcrypt hash: %v", user, err)
+		}
+	}
+
+	if config.BearerTokenFile != "" {
+		token, err := os.ReadFile(config.BearerTokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Reading bearer token %s failed: %v", config.BearerTokenFile, err)
+		}
+		config.bearerToken = strings.TrimSpace(string(token))
+		if config.bearerToken == "" {
+			return nil, errors.Errorf("Bearer token %s is empty", config.BearerTokenFile)
+		}
+	}
+
+	if tlsConfig := config.TLSServerConfig; tlsConfig != nil {
+		if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+			return nil, errors.New("tls_server_config needs both cert_file and key_file")
+		}
+		clientAuth, ok := clientAuthTypes[tlsConfig.ClientAuthType]
+		if !ok {
+			return nil, errors.Errorf("client_auth_type %s is invalid", tlsConfig.ClientAuthType)
+		}
+		verifying := clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert
+		if tlsConfig.ClientCAFile == "" && verifying {
+			return nil, errors.Errorf("client_auth_type %s needs a client_ca_file", tlsConfig.ClientAuthType)
+		}
+		if len(tlsConfig.ClientAllowedSans) > 0 && !verifying {
+			return nil, errors.New("client_allowed_sans needs a client_auth_type verifying the client certificates")
+		}
+		if _, err := tlsConfig.tlsOptions(); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// unsupportedWebConfigKeys returns the dotted keys of the web config that aren't in webConfigKeys.
+func unsupportedWebConfigKeys(content []byte) []string {
+	var sections map[string]interface{}
+	if err := yaml.Unmarshal(content, &sections); err != nil {
+		return nil
+	}
+
+	var unsupported []string
+	for key, value := range sections {
+		if !slices.Contains(webConfigKeys[""], key) {
+			unsupported = append(unsupported, key)
+			continue
+		}
+		section, ok := value.(map[string]interface{})
+		if _, hasKeys := webConfigKeys[key]; !ok || !hasKeys {
+			// eg the usernames of basic_auth_users
+			continue
+		}
+		for sectionKey := range section {
+			if !slices.Contains(webConfigKeys[key], sectionKey) {
+				unsupported = append(unsupported, key+"."+sectionKey)
+			}
+		}
+	}
+	sort.Strings(unsupported)
+	return unsupported
+}
+
+// tlsOptions are the protocol options of the config: the versions, cipher suites and curves.
+type tlsOptions struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+func (c *tlsServerConfig) tlsOptions() (*tlsOptions, error) {
+	options := &tlsOptions{minVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, errors.Errorf("min_version %s is invalid", c.MinVersion)
+		}
+		options.minVersion = version
+	}
+	if c.MaxVersion != "" {
+		version, ok := tlsVersions[c.MaxVersion]
+		if !ok {
+			return nil, errors.Errorf("max_version %s is invalid", c.MaxVersion)
+		}
+		if version < options.minVersion {
+			return nil, errors.Errorf("max_version %s is lower than the min_version", c.MaxVersion)
+		}
+		options.maxVersion = version
+	}
+
+	suites := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range c.CipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return nil, errors.Errorf("cipher suite %s is invalid", name)
+		}
+		options.cipherSuites = append(options.cipherSuites, id)
+	}
+
+	for _, name := range c.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, errors.Errorf("curve %s is invalid", name)
+		}
+		options.curves = append(options.curves, curve)
+	}
+	return options, nil
+}
+
+// verifyClientSans rejects client certificates without any of the allowed SANs.
+func (c *tlsServerConfig) verifyClientSans(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return errors.New("client certificate is not verified")
+	}
+	leaf := verifiedChains[0][0]
+
+	sans := append(append([]string{}, leaf.DNSNames...), leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if slices.Contains(c.ClientAllowedSans, san) {
+			return nil
+		}
+	}
+	return errors.Errorf("client certificate SANs %s are not allowed", strings.Join(sans, ", "))
+}
+
+// serverTLSConfig returns the TLS config of the server, nil when it serves plain HTTP. The
+// certificate is reloaded when its files change.
+func (c *webConfig) serverTLSConfig() (*tls.Config, error) {
+	if c.TLSServerConfig == nil {
+		return nil, nil
+	}
+
+	certificate := &certReloader{certFile: c.TLSServerConfig.CertFile, keyFile: c.TLSServerConfig.KeyFile}
+	if _, err := certificate.getCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	options, err := c.TLSServerConfig.tlsOptions()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:       options.minVersion,
+		MaxVersion:       options.maxVersion,
+		CipherSuites:     options.cipherSuites,
+		CurvePreferences: options.curves,
+		ClientAuth:       clientAuthTypes[c.TLSServerConfig.ClientAuthType],
+		GetCertificate:   certificate.getCertificate,
+	}
+	if len(c.TLSServerConfig.ClientAllowedSans) > 0 {
+		config.VerifyPeerCertificate = c.TLSServerConfig.verifyClientSans
+	}
+
+	if c.TLSServerConfig.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.TLSServerConfig.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Reading client CA %s failed: %v", c.TLSServerConfig.ClientCAFile, err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("Client CA %s has no certificates", c.TLSServerConfig.ClientCAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// certReloader loads the certificate and its key again once either file has been modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime := time.Time{}
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			if c.certificate != nil {
+				return c.certificate, nil
+			}
+			return nil, errors.Wrapf(err, "Stat %s failed: %v", path, err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.certificate != nil && modTime.Equal(c.modTime) {
+		return c.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.certificate != nil {
+			// keep serving the old certificate while the new one is only partly written
+			return c.certificate, nil
+		}
+		return nil, errors.Wrapf(err, "Loading certificate %s failed: %v", c.certFile, err)
+	}
+	c.certificate = &certificate
+	c.modTime = modTime
+	return c.certificate, nil
+}
+
+// authHandler requires the basic auth users or the bearer token of the config, if any, on
+// every path except the unauthenticated ones.
+type authHandler struct {
+	config          *webConfig
+	handler         http.Handler
+	unauthenticated map[string]bool
+
+	// the credentials that passed bcrypt, so a scrape doesn't pay for it every time
+	mu     sync.Mutex
+	passed map[string]bool
+}
+
+func newAuthHandler(config *webConfig, handler http.Handler, unauthenticated ...string) http.Handler {
+	if len(config.BasicAuthUsers) == 0 && config.bearerToken == "" {
+		return handler
+	}
+	h := &authHandler{config: config, handler: handler, unauthenticated: map[string]bool{}, passed: map[string]bool{}}
+	for _, path := range unauthenticated {
+		h.unauthenticated[path] = true
+	}
+	return h
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.unauthenticated[req.URL.Path] || h.authorized(req) {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+	if len(h.config.BasicAuthUsers) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="module-metrics"`)
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (h *authHandler) authorized(req *http.Request) bool {
+	authorization := req.Header.Get("Authorization")
+	if h.config.bearerToken != "" && strings.HasPrefix(authorization, "Bearer ") {
+		token := authorization[len("Bearer "):]
+		return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.bearerToken)) == 1
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok || len(h.config.BasicAuthUsers) == 0 {
+		return false
+	}
+	hash, ok := h.config.BasicAuthUsers[user]
+	if !ok {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s", user, hash, password)))
+	key := hex.EncodeToString(sum[:])
+	h.mu.Lock()
+	passed := h.passed[key]
+	h.mu.Unlock()
+	if passed {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	h.mu.Lock()
+	h.passed[key] = true
+	h.mu.Unlock()
+	return true
+}
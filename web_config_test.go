@@ -0,0 +1,289 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCertificate writes a certificate and its key signed by the parent, or self-signed
+// without one, returning the paths and the parsed certificate and key.
+func writeCertificate(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := path.Join(dir, name+".crt")
+	keyFile := path.Join(dir, name+".key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return certFile, keyFile, certificate, key
+}
+
+func writeWebConfig(t *testing.T, dir string, content string) string {
+	file := path.Join(dir, "web.yml")
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+	return file
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	tokenFile := path.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("a-token\n"), 0600))
+
+	config, err := loadWebConfig(writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+basic_auth_users:
+  prometheus: `+string(hash)+`
+bearer_token_file: `+tokenFile+`
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, &tlsServerConfig{
+		CertFile:       "server.crt",
+		KeyFile:        "server.key",
+		ClientAuthType: "RequireAndVerifyClientCert",
+		ClientCAFile:   "ca.crt",
+	}, config.TLSServerConfig)
+	assert.Equal(t, map[string]string{"prometheus": string(hash)}, config.BasicAuthUsers)
+	assert.Equal(t, "a-token", config.bearerToken)
+
+	config, err = loadWebConfig(writeWebConfig(t, dir, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, &webConfig{}, config)
+
+	invalid := []string{
+		"basic_auth_users:\n  prometheus: plaintext\n",
+		"tls_server_config:\n  cert_file: server.crt\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_auth_type: Sometimes\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_auth_type: RequireAndVerifyClientCert\n",
+		"bearer_token_file: " + path.Join(dir, "missing") + "\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  min_version: SSL3\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  min_version: TLS13\n  max_version: TLS12\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  cipher_suites: [TLS_NOPE]\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  curve_preferences: [CurveP1]\n",
+		"tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_allowed_sans: [client]\n",
+	}
+	for _, content := range invalid {
+		_, err = loadWebConfig(writeWebConfig(t, dir, content))
+		assert.Error(t, err, content)
+	}
+	_, err = loadWebConfig(path.Join(dir, "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestLoadWebConfigExporterToolkit(t *testing.T) {
+	dir := t.TempDir()
+
+	config, err := loadWebConfig(writeWebConfig(t, dir, `
+tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+  client_allowed_sans: [prometheus.example.com]
+  min_version: TLS12
+  max_version: TLS13
+  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]
+  curve_preferences: [X25519, CurveP256]
+  prefer_server_cipher_suites: true
+http_server_config:
+  http2: false
+  headers:
+    X-Frame-Options: deny
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prometheus.example.com"}, config.TLSServerConfig.ClientAllowedSans)
+
+	options, err := config.TLSServerConfig.tlsOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, &tlsOptions{
+		minVersion:   tls.VersionTLS12,
+		maxVersion:   tls.VersionTLS13,
+		cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		curves:       []tls.CurveID{tls.X25519, tls.CurveP256},
+	}, options)
+
+	assert.Equal(t, []string{"http_server_config", "tls_server_config.prefer_server_cipher_suites"},
+		unsupportedWebConfigKeys([]byte(`
+tls_server_config:
+  cert_file: server.crt
+  prefer_server_cipher_suites: true
+http_server_config:
+  http2: false
+basic_auth_users:
+  prometheus: hash
+`)))
+}
+
+func TestAuthHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	config := &webConfig{BasicAuthUsers: map[string]string{"prometheus": string(hash)}, bearerToken: "a-token"}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})
+	handler := newAuthHandler(config, ok, defaultHealthzPath)
+
+	cases := []struct {
+		path     string
+		setup    func(req *http.Request)
+		expected int
+	}{
+		{"/metrics", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"/metrics", func(req *http.Request) { req.SetBasicAuth("prometheus", "secret") }, http.StatusOK},
+		{"/metrics", func(req *http.Request) { req.SetBasicAuth("prometheus", "secret") }, http.StatusOK},
+		{"/metrics", func(req *http.Request) { req.SetBasicAuth("prometheus", "wrong") }, http.StatusUnauthorized},
+		{"/metrics", func(req *http.Request) { req.SetBasicAuth("other", "secret") }, http.StatusUnauthorized},
+		{"/metrics", func(req *http.Request) { req.Header.Set("Authorization", "Bearer a-token") }, http.StatusOK},
+		{"/metrics", func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{defaultHealthzPath, func(req *http.Request) {}, http.StatusOK},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		c.setup(req)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, c.expected, recorder.Code, "case %d", i)
+		if c.expected == http.StatusUnauthorized {
+			assert.Equal(t, `Basic realm="module-metrics"`, recorder.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	_, isAuthHandler := newAuthHandler(&webConfig{}, ok).(*authHandler)
+	assert.False(t, isAuthHandler)
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _, ca, caKey := writeCertificate(t, dir, "ca", nil, nil)
+	certFile, keyFile, _, _ := writeCertificate(t, dir, "server", ca, caKey)
+	clientCertFile, clientKeyFile, _, _ := writeCertificate(t, dir, "client", ca, caKey)
+
+	config := &webConfig{TLSServerConfig: &tlsServerConfig{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ClientAuthType: "RequireAndVerifyClientCert",
+		ClientCAFile:   caFile,
+	}}
+	tlsConfig, err := config.serverTLSConfig()
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}), TLSConfig: tlsConfig}
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCertificate, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	assert.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = client.Get(url)
+	assert.Error(t, err, "client certificate is required")
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCertificate},
+	}}}
+	resp, err := client.Get(url)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the client certificate has the SAN 127.0.0.1
+	for sans, allowed := range map[string]bool{"127.0.0.1": true, "prometheus.example.com": false} {
+		config.TLSServerConfig.ClientAllowedSans = []string{sans}
+		tlsConfig, err = config.serverTLSConfig()
+		assert.NoError(t, err)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}), TLSConfig: tlsConfig}
+		go func() { _ = server.ServeTLS(listener, "", "") }()
+		defer server.Close()
+		resp, err = client.Get("https://" + listener.Addr().String())
+		if allowed && assert.NoError(t, err, sans) {
+			resp.Body.Close()
+		}
+		if !allowed {
+			assert.Error(t, err, sans)
+		}
+	}
+
+	config.TLSServerConfig.ClientCAFile = certFile + ".missing"
+	_, err = config.serverTLSConfig()
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first, _ := writeCertificate(t, dir, "server", nil, nil)
+
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	certificate, err := reloader.getCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Raw, certificate.Certificate[0])
+
+	_, _, second, _ := writeCertificate(t, dir, "server", nil, nil)
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	certificate, err = reloader.getCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Raw, certificate.Certificate[0])
+
+	// a broken certificate keeps the last one
+	assert.NoError(t, os.WriteFile(certFile, []byte("partial"), 0600))
+	even := later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, even, even))
+	certificate, err = reloader.getCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Raw, certificate.Certificate[0])
+
+	_, err = (&certReloader{certFile: certFile, keyFile: keyFile}).getCertificate(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// workerQueueLines is the number of lines per worker a reader dispatches ahead of the output.
+const workerQueueLines = 64
+
+var (
+	workers = 1
+
+	// workersMu guards the current pool and the number of readers using each pool
+	workersMu   sync.Mutex
+	currentPool *workerPool
+)
+
+// workerPool is a set of workers fed by the readers that started dispatching while it was
+// the current pool. A replaced pool is stopped once the last of its readers has stopped.
+type workerPool struct {
+	jobs    chan *lineJob
+	readers int
+}
+
+// lineJob is a line dispatched to the workers, done is closed once it has been processed.
+type lineJob struct {
+	reader    *reader
+	line      []byte
+	truncated bool
+	commit    func()
+	done      chan struct{}
+
+	output []byte
+	fields map[string]string
+	write  bool
+}
+
+// SetWorkers sets the number of goroutines that parse and aggregate the log lines in parallel.
+// With more than one the counters are sharded per worker and the lines are still written to
+// the output in the order they were read. Must be called before InitMetrics.
+func SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n == workers {
+		return
+	}
+	workers = n
+	startWorkers()
+}
+
+// setupWorkers applies MODULE_METRICS_WORKERS.
+func setupWorkers() error {
+	workersStr := os.Getenv("MODULE_METRICS_WORKERS")
+	if workersStr == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(workersStr)
+	if err != nil {
+		return errors.Wrapf(err, "MODULE_METRICS_WORKERS %s is invalid", workersStr)
+	}
+	SetWorkers(n)
+	return nil
+}
+
+// startWorkers starts the worker pool used by the readers started afterwards. Readers already
+// started keep the pool they were started with, it's stopped once they have all stopped.
+func startWorkers() {
+	var pool *workerPool
+	if workers > 1 {
+		pool = &workerPool{jobs: make(chan *lineJob, workers*workerQueueLines)}
+		for i := 0; i < workers; i++ {
+			go runWorker(pool.jobs, i)
+		}
+	}
+
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	previous := currentPool
+	currentPool = pool
+	if previous != nil && previous.readers == 0 {
+		close(previous.jobs)
+	}
+}
+
+// acquireWorkers returns the current pool for a reader to dispatch its lines to, nil when the
+// lines are processed by the readers themselves.
+func acquireWorkers() *workerPool {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	if currentPool != nil {
+		currentPool.readers++
+	}
+	return currentPool
+}
+
+// release stops the workers of a replaced pool once no reader uses it.
+func (pool *workerPool) release() {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	pool.readers--
+	if pool.readers == 0 && pool != currentPool {
+		close(pool.jobs)
+	}
+}
+
+func runWorker(jobs chan *lineJob, shard int) {
+	for job := range jobs {
+		job.output, job.fields, job.write = job.reader.process(job.line, job.truncated, shard)
+		close(job.done)
+	}
+}
+
+// dispatch processes the line, on the workers if there are any, calling commit once it has been
+// written. Called from a single goroutine per reader.
+func (r *reader) dispatch(line []byte, truncated bool, commit func()) {
+	if !r.dispatching {
+		r.dispatching = true
+		r.pool = acquireWorkers()
+		if r.pool != nil {
+			r.results = make(chan *lineJob, cap(r.pool.jobs))
+			go r.writeResults()
+		}
+	}
+	if r.pool == nil {
+		if output, fields, write := r.process(line, truncated, 0); write {
+			r.write(output, fields)
+		}
+		if commit != nil {
+			commit()
+		}
+		return
+	}
+
+	job := &lineJob{reader: r, line: line, truncated: truncated, commit: commit, done: make(chan struct{})}
+	r.inFlight.Add(1)
+	// queue for the output before the workers so the results are written in order
+	r.results <- job
+	r.pool.jobs <- job
+}
+
+// writeResults writes the processed lines to the output in the order they were dispatched.
+func (r *reader) writeResults() {
+	for job := range r.results {
+		<-job.done
+		if job.write {
+			r.write(job.output, job.fields)
+		}
+		if job.commit != nil {
+			job.commit()
+		}
+		r.inFlight.Done()
+	}
+}
+
+// drain waits until the lines dispatched to the workers have been written.
+func (r *reader) drain() {
+	r.inFlight.Wait()
+}
+
+// stopDispatching drains the lines dispatched to the workers and releases the pool, the next
+// line dispatched starts with the current pool.
+func (r *reader) stopDispatching() {
+	r.drain()
+	if r.pool != nil {
+		close(r.results)
+		r.pool.release()
+		r.pool = nil
+	}
+	r.dispatching = false
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkersKeepOutputOrder(t *testing.T) {
+	defer SetWorkers(1)
+	SetWorkers(4)
+	InitMetrics("status")
+
+	var logs strings.Builder
+	for i := 0; i < 1000; i++ {
+		if i%100 == 99 {
+			logs.WriteString("not json\n")
+			continue
+		}
+		fmt.Fprintf(&logs, `{"status":"%d","bytes":"10","content_type":"text/html","line":%d}`+"\n", 200+i%2, i)
+	}
+
+	var stdout bytes.Buffer
+	r := &reader{source: "test", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+	r.run(io.NopCloser(strings.NewReader(logs.String())))
+
+	assert.Equal(t, logs.String(), stdout.String())
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="200"} 500`)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false",status="201"} 490`)
+	assert.Contains(t, actual, `section_http_bytes_total{status="201"} 4900`)
+	assert.Contains(t, actual, `section_http_page_view_total 990`)
+	assert.Contains(t, actual, `section_http_json_parse_errors_total{reason="not_an_object"} 10`)
+	assert.Contains(t, actual, `section_http_passthrough_lines_total{result="forwarded"} 1000`)
+}
+
+func TestShardedCounterVec(t *testing.T) {
+	defer SetWorkers(1)
+	SetWorkers(3)
+	InitMetrics()
+
+	assert.Contains(t, gatherP8sResponse(t), `section_http_page_view_total 0`)
+
+	requestsTotal.shard(0).WithLabelValues("false").Inc()
+	requestsTotal.shard(1).WithLabelValues("false").Add(2)
+	requestsTotal.shard(5).WithLabelValues("true").Inc()
+	pageViewTotal.shard(2).WithLabelValues().Inc()
+
+	actual := gatherP8sResponse(t)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="false"} 3`)
+	assert.Contains(t, actual, `section_http_request_count_total{section_aee_healthcheck="true"} 1`)
+	assert.Contains(t, actual, `section_http_page_view_total 1`)
+
+	// the latest exemplar of the shards is kept
+	addWithExemplar(requestsTotal.shard(1).WithLabelValues("false"), 1, prometheus.Labels{"trace_id": "first"})
+	addWithExemplar(requestsTotal.shard(0).WithLabelValues("false"), 1, prometheus.Labels{"trace_id": "second"})
+	assert.Contains(t, gatherOpenMetrics(t), `section_http_request_count_total{section_aee_healthcheck="false"} 5.0 # {trace_id="second"} 1.0 `)
+}
+
+func TestWorkersCommitWrittenLines(t *testing.T) {
+	defer SetWorkers(1)
+	SetWorkers(4)
+	InitMetrics()
+
+	var stdout bytes.Buffer
+	r := &reader{source: "test", parser: JSONParser, output: &stdout, errorWriter: io.Discard}
+
+	var committed []int
+	for i := 0; i < 100; i++ {
+		line := []byte(fmt.Sprintf(`{"status":"200","line":%d}`+"\n", i))
+		i := i
+		r.dispatch(line, false, func() {
+			// the line has been written before it is committed
+			assert.Equal(t, i+1, strings.Count(stdout.String(), "\n"))
+			committed = append(committed, i)
+		})
+	}
+	r.drain()
+
+	assert.Len(t, committed, 100)
+	assert.Equal(t, 99, committed[len(committed)-1])
+}
+
+func TestSetWorkersStopsReplacedPool(t *testing.T) {
+	defer SetWorkers(1)
+	SetWorkers(4)
+	InitMetrics()
+	unused := currentPool
+
+	SetWorkers(4)
+	assert.Same(t, unused, currentPool)
+
+	SetWorkers(2)
+	_, open := <-unused.jobs
+	assert.False(t, open)
+
+	r := &reader{source: "test", parser: JSONParser, output: io.Discard, errorWriter: io.Discard}
+	r.dispatch([]byte(`{"status":"200"}`+"\n"), false, nil)
+	used := r.pool
+
+	// the pool is kept until the reader using it stops
+	SetWorkers(3)
+	r.dispatch([]byte(`{"status":"200"}`+"\n"), false, nil)
+	r.stopDispatching()
+	_, open = <-used.jobs
+	assert.False(t, open)
+
+	r.dispatch([]byte(`{"status":"200"}`+"\n"), false, nil)
+	assert.Same(t, currentPool, r.pool)
+	r.stopDispatching()
+}